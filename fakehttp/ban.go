@@ -0,0 +1,107 @@
+package fakehttp
+
+import (
+	"sync"
+	"time"
+)
+
+// fail2ban like: ban address for banTime after maxFail fails in findTime
+type banList struct {
+	mx      sync.Mutex
+	list    map[string]*banEntry
+}
+
+type banEntry struct {
+	count   int
+	first   time.Time
+	until   time.Time
+}
+
+func newBanList() (*banList) {
+	return &banList{
+		list: make(map[string]*banEntry),
+	}
+}
+
+// return true if banned by this fail
+func (bl *banList) fail(ip string, maxFail int, findTime time.Duration, banTime time.Duration) (bool) {
+	if maxFail <= 0 {
+		return false
+	}
+
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	now := time.Now()
+	e, ok := bl.list[ip]
+	if !ok || now.Sub(e.first) > findTime {
+		e = &banEntry{
+			first: now,
+		}
+		bl.list[ip] = e
+	}
+	if now.Before(e.until) {
+		return false
+	}
+
+	e.count++
+	if e.count >= maxFail {
+		e.until = now.Add(banTime)
+		e.count = 0
+		return true
+	}
+	return false
+}
+
+func (bl *banList) banned(ip string) (bool) {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	e, ok := bl.list[ip]
+	if !ok {
+		return false
+	}
+	return time.Now().Before(e.until)
+}
+
+// ip -> ban until
+func (bl *banList) bans() (map[string]time.Time) {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	now := time.Now()
+	ret := make(map[string]time.Time)
+	for ip, e := range bl.list {
+		if now.Before(e.until) {
+			ret[ip] = e.until
+		}
+	}
+	return ret
+}
+
+// empty ip to clear all, return false if not found
+func (bl *banList) unban(ip string) (bool) {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	if ip == "" {
+		bl.list = make(map[string]*banEntry)
+		return true
+	}
+
+	_, ok := bl.list[ip]
+	delete(bl.list, ip)
+	return ok
+}
+
+func (bl *banList) clean(findTime time.Duration) {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	now := time.Now()
+	for ip, e := range bl.list {
+		if now.After(e.until) && now.Sub(e.first) > findTime {
+			delete(bl.list, ip)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package fakehttp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	bl := newBanList()
+	ip := "192.0.2.1"
+	for i := 1; i < 3; i++ {
+		if bl.fail(ip, 3, time.Minute, time.Hour) {
+			t.Fatalf("banned after %d fail", i)
+		}
+		if bl.banned(ip) {
+			t.Fatalf("banned after %d fail", i)
+		}
+	}
+	if !bl.fail(ip, 3, time.Minute, time.Hour) {
+		t.Fatal("not banned after 3 fail")
+	}
+	if !bl.banned(ip) {
+		t.Fatal("not banned")
+	}
+	if bl.banned("192.0.2.2") {
+		t.Fatal("other address banned")
+	}
+	if _, ok := bl.bans()[ip]; !ok {
+		t.Fatal("not in bans()")
+	}
+	if bl.fail(ip, 3, time.Minute, time.Hour) {
+		t.Fatal("banned again while banned")
+	}
+}
+
+func TestBanListDisabled(t *testing.T) {
+	bl := newBanList()
+	for i := 0; i < 10; i++ {
+		if bl.fail("192.0.2.1", 0, time.Minute, time.Hour) {
+			t.Fatal("banned with maxFail 0")
+		}
+	}
+	if bl.banned("192.0.2.1") {
+		t.Fatal("banned with maxFail 0")
+	}
+}
+
+func TestBanListFindTime(t *testing.T) {
+	bl := newBanList()
+	bl.fail("192.0.2.1", 2, 10 * time.Millisecond, time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if bl.fail("192.0.2.1", 2, 10 * time.Millisecond, time.Hour) {
+		t.Fatal("fail out of find time counted")
+	}
+}
+
+func TestBanListExpire(t *testing.T) {
+	bl := newBanList()
+	bl.fail("192.0.2.1", 1, time.Minute, 10 * time.Millisecond)
+	if !bl.banned("192.0.2.1") {
+		t.Fatal("not banned")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if bl.banned("192.0.2.1") {
+		t.Fatal("still banned after ban time")
+	}
+	bl.clean(0)
+	if len(bl.list) != 0 {
+		t.Fatal("expired entry not cleaned")
+	}
+}
+
+func TestUnban(t *testing.T) {
+	bl := newBanList()
+	bl.fail("192.0.2.1", 1, time.Minute, time.Hour)
+	bl.fail("192.0.2.2", 1, time.Minute, time.Hour)
+	if !bl.unban("192.0.2.1") || bl.banned("192.0.2.1") {
+		t.Fatal("unban fail")
+	}
+	if bl.unban("192.0.2.1") {
+		t.Fatal("unban unknown address return true")
+	}
+	if !bl.unban("") || bl.banned("192.0.2.2") {
+		t.Fatal("unban all fail")
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		in    string
+		out   []string
+		err   bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, false},
+		{"192.0.2.1", []string{"192.0.2.1/32"}, false},
+		{"2001:db8::1", []string{"2001:db8::1/128"}, false},
+		{"10.1.2.3/8, 2001:db8::/32", []string{"10.0.0.0/8", "2001:db8::/32"}, false},
+		{"10.0.0.0/33", nil, true},
+		{"example.com", nil, true},
+		{"10.0.0.0/8,bad", nil, true},
+	}
+	for _, tt := range tests {
+		list, err := ParseCIDRs(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: err %v", tt.in, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if len(list) != len(tt.out) {
+			t.Errorf("%q: got %v, want %v", tt.in, list, tt.out)
+			continue
+		}
+		for i, n := range list {
+			if n.String() != tt.out[i] {
+				t.Errorf("%q: got %v, want %v", tt.in, n, tt.out[i])
+			}
+		}
+	}
+}
+
+func TestInNets(t *testing.T) {
+	list, _ := ParseCIDRs("10.0.0.0/8,2001:db8::/32")
+	tests := []struct {
+		ip    string
+		in    bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"2001:db8::5", true},
+		{"2001:db9::5", false},
+		{"::ffff:10.0.0.1", true},
+		{"", false},
+		{"not ip", false},
+	}
+	for _, tt := range tests {
+		if inNets(tt.ip, list) != tt.in {
+			t.Errorf("%q: want %v", tt.ip, tt.in)
+		}
+	}
+	if inNets("10.0.0.1", nil) {
+		t.Error("empty list contain address")
+	}
+}
+
+func TestTunnelAllowed(t *testing.T) {
+	srv := NewServer(nil)
+	srv.Allow, _ = ParseCIDRs("10.0.0.0/8")
+	srv.Deny, _ = ParseCIDRs("10.0.0.1")
+	tests := []struct {
+		ip    string
+		ok    bool
+	}{
+		{"10.0.0.2", true},
+		{"10.0.0.1", false},
+		{"192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		if srv.tunnelAllowed(tt.ip) != tt.ok {
+			t.Errorf("%q: want %v", tt.ip, tt.ok)
+		}
+	}
+
+	srv.BanMaxFail = 1
+	srv.fail("10.0.0.2", "test")
+	if srv.tunnelAllowed("10.0.0.2") {
+		t.Error("banned address allowed")
+	}
+}
@@ -0,0 +1,149 @@
+package fakehttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	coverMaxAssets = 16
+)
+
+var assetRe = regexp.MustCompile(`(?is)<(link|script|img)\b([^>]*?)\b(?:href|src)\s*=\s*["']([^"']+)["']`)
+
+// same URL as page for cookie domain
+func (cl *Client) pageURL() (*url.URL) {
+	u, err := url.Parse(cl.getOrigin() + cl.Url)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// Cookie header from Jar, skip names set by tunnel
+func (cl *Client) jarCookie(skip ...string) (string) {
+	if cl.Jar == nil {
+		return ""
+	}
+	u := cl.pageURL()
+	if u == nil {
+		return ""
+	}
+
+	var list []string
+NEXT:
+	for _, c := range cl.Jar.Cookies(u) {
+		for _, name := range skip {
+			if c.Name == name {
+				continue NEXT
+			}
+		}
+		list = append(list, c.Name + "=" + c.Value)
+	}
+	return strings.Join(list, "; ")
+}
+
+func (cl *Client) saveCookie(res *http.Response) {
+	if cl.Jar == nil {
+		return
+	}
+	if u := cl.pageURL(); u != nil {
+		cl.Jar.SetCookies(u, res.Cookies())
+	}
+}
+
+// css/js/img on same site, like browser after page load
+func (cl *Client) fetchAssets(res *http.Response, body []byte) {
+	base := cl.pageURL()
+	if base == nil {
+		return
+	}
+	var r io.Reader
+	var err error
+	switch res.Header.Get("Content-Encoding") { // only codec Profile Accept-Encoding ask
+	case codecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case codecDeflate:
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return
+	}
+	if r != nil {
+		body, _ = ioutil.ReadAll(r)
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range assetRe.FindAllStringSubmatch(string(body), -1) {
+		if len(seen) >= coverMaxAssets {
+			break
+		}
+		tag, attr, ref := strings.ToLower(m[1]), strings.ToLower(m[2]), m[3]
+		u, err := base.Parse(ref)
+		if err != nil || u.Host != base.Host || seen[u.Path] {
+			continue
+		}
+		seen[u.Path] = true
+
+		dest, accept := "image", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+		switch {
+		case tag == "script":
+			dest, accept = "script", "*/*"
+		case tag == "link" && strings.Contains(attr, "stylesheet"):
+			dest, accept = "style", "text/css,*/*;q=0.1"
+		}
+		cl.fetchAsset(u.RequestURI(), dest, accept)
+	}
+}
+
+func (cl *Client) fetchAsset(path string, dest string, accept string) {
+	req, err := http.NewRequest("GET", cl.Dialer.GetProto() + cl.getAddr() + path, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", cl.UserAgent)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Sec-Fetch-Dest", dest)
+	req.Header.Set("Referer", cl.getOrigin() + cl.Url)
+	if cookie := cl.jarCookie(); cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	req.Host = cl.Host
+	req.Close = true
+
+	res, err := cl.do(req, func(p *Profile) ([]string) { return p.Asset })
+	if err != nil {
+		Vlogln(3, "cover fetch err:", path, err)
+		return
+	}
+	defer res.Body.Close()
+	cl.saveCookie(res)
+	io.Copy(ioutil.Discard, res.Body)
+	Vlogln(4, "cover fetch:", path, res.Status)
+}
+
+func (cl *Client) startCover() {
+	cl.coverOnce.Do(func() {
+		go cl.cover()
+	})
+}
+
+// revisit page at random time, so not only tunnel on the site
+func (cl *Client) cover() {
+	for {
+		d := cl.CoverInterval / 2 + time.Duration(mrand.Int63n(int64(cl.CoverInterval)))
+		time.Sleep(d)
+		if _, err := cl.getToken(); err != nil {
+			Vlogln(3, "cover revisit err:", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package fakehttp
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	codecGzip = "gzip" // http mode, Content-Encoding
+	codecDeflate = "deflate" // ws mode, raw deflate stream, ask by cookie
+)
+
+// compress stream, flush every Write so interactive traffic not delayed
+type compConn struct {
+	net.Conn
+	codec    string
+
+	rOnce    sync.Once
+	r        io.Reader
+	rErr     error
+
+	wmx      sync.Mutex
+	w        flushWriteCloser
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// empty codec for no compress in that direction
+func newCompConn(conn net.Conn, rCodec string, wCodec string) (net.Conn) {
+	if rCodec == "" && wCodec == "" {
+		return conn
+	}
+	c := &compConn{
+		Conn: conn,
+		codec: rCodec,
+	}
+	switch wCodec {
+	case codecGzip:
+		c.w, _ = gzip.NewWriterLevel(conn, gzip.BestSpeed)
+	case codecDeflate:
+		c.w, _ = flate.NewWriter(conn, flate.BestSpeed)
+	}
+	return c
+}
+
+func (c *compConn) Read(b []byte) (int, error) {
+	// gzip.NewReader() block for header, create on first Read()
+	c.rOnce.Do(func() {
+		switch c.codec {
+		case codecGzip:
+			c.r, c.rErr = gzip.NewReader(c.Conn)
+		case codecDeflate:
+			c.r = flate.NewReader(c.Conn)
+		default:
+			c.r = c.Conn
+		}
+	})
+	if c.rErr != nil {
+		return 0, c.rErr
+	}
+	return c.r.Read(b)
+}
+
+func (c *compConn) Write(b []byte) (int, error) {
+	if c.w == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *compConn) Close() (error) {
+	if c.w != nil {
+		c.wmx.Lock()
+		c.w.Close()
+		c.wmx.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+func acceptGzip(h http.Header) (bool) {
+	for _, v := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.Split(v, ";")[0]) == codecGzip {
+			return true
+		}
+	}
+	return false
+}
@@ -16,6 +16,9 @@ const (
 	tokenCookieA = "cna"
 	tokenCookieB = "_tb_token_"
 	tokenCookieC = "_cna"
+	keyCookie = "_sid"
+	shapeCookie = "_gid"
+	compCookie = "_gat"
 
 	userAgent = "Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/47.0.2526.80 Safari/537.36 QQBrowser/9.3.6874.400"
 	headerServer = "nginx"
@@ -23,6 +26,25 @@ const (
 	timeout = 10 * time.Second
 	tokenTTL = 20 * time.Second
 	tokenClean = 10 * time.Second
+	pairTimeout = 3 * time.Second
+	replayCacheSize = 65536
+
+	banFindTime = 10 * time.Minute
+	banTime = 1 * time.Hour
+
+	tlsSessionCacheSize = 64
+
+	backoffMin = 1 * time.Second
+	backoffMax = 5 * time.Minute
+	probeInterval = 30 * time.Second
+
+	poolMaxIdle = 60 * time.Second
+	poolCheck = 5 * time.Second
+	poolCheckMin = 100 * time.Millisecond // for very short MaxIdle
+	poolBackoffMax = 30 * time.Second
+
+	shapeBudget = 0.5
+	shapeCredit = 4096 // padding allowed before budget count, hide handshake of inner protocol
 )
 
 
@@ -0,0 +1,165 @@
+package fakehttp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	ErrNoKey           = errors.New("no key exchange from peer")
+)
+
+const (
+	cryptMaxRecord = 16 * 1024
+)
+
+// X25519 key pair for each tunnel, public key carried in cookie
+func newKeyPair() (*ecdh.PrivateKey, string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	return priv, base64.RawURLEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+// AES-256-GCM key for each direction, PSK mixed in to authenticate peer
+// without PSK, anyone can terminate TLS (CDN, proxy) can replace both public key
+func deriveKeys(priv *ecdh.PrivateKey, peerPub string, psk []byte, token string, isClient bool) ([]byte, []byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientPub, serverPub := priv.PublicKey().Bytes(), pub.Bytes()
+	if !isClient {
+		clientPub, serverPub = serverPub, clientPub
+	}
+	info := token + string(clientPub) + string(serverPub)
+
+	c2s, err := hkdf.Key(sha256.New, secret, psk, "httptun c2s " + info, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	s2c, err := hkdf.Key(sha256.New, secret, psk, "httptun s2c " + info, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if isClient {
+		return s2c, c2s, nil
+	}
+	return c2s, s2c, nil
+}
+
+// record: 2 bytes length + AES-GCM sealed data, nonce is record counter
+type cryptConn struct {
+	net.Conn
+
+	rmx      sync.Mutex
+	rAead    cipher.AEAD
+	rNonce   uint64
+	rBuf     []byte
+
+	wmx      sync.Mutex
+	wAead    cipher.AEAD
+	wNonce   uint64
+}
+
+func newCryptConn(conn net.Conn, rKey []byte, wKey []byte) (net.Conn, error) {
+	rAead, err := newAead(rKey)
+	if err != nil {
+		return nil, err
+	}
+	wAead, err := newAead(wKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptConn{
+		Conn: conn,
+		rAead: rAead,
+		wAead: wAead,
+	}, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func mkNonce(aead cipher.AEAD, n uint64) ([]byte) {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce) - 8:], n)
+	return nonce
+}
+
+func (c *cryptConn) Read(b []byte) (int, error) {
+	c.rmx.Lock()
+	defer c.rmx.Unlock()
+
+	if len(c.rBuf) == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		plain, err := c.rAead.Open(buf[:0], mkNonce(c.rAead, c.rNonce), buf, hdr[:])
+		if err != nil {
+			return 0, err
+		}
+		c.rNonce++
+		c.rBuf = plain
+	}
+
+	n := copy(b, c.rBuf)
+	c.rBuf = c.rBuf[n:]
+	return n, nil
+}
+
+func (c *cryptConn) Write(b []byte) (int, error) {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+
+	total := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > cryptMaxRecord {
+			n = cryptMaxRecord
+		}
+
+		buf := make([]byte, 2, 2 + n + c.wAead.Overhead())
+		binary.BigEndian.PutUint16(buf, uint16(n + c.wAead.Overhead()))
+		buf = c.wAead.Seal(buf, mkNonce(c.wAead, c.wNonce), b[:n], buf[:2])
+		c.wNonce++
+
+		if _, err := c.Conn.Write(buf); err != nil {
+			return total, err
+		}
+		total += n
+		b = b[n:]
+	}
+	return total, nil
+}
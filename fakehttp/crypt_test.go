@@ -0,0 +1,202 @@
+package fakehttp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// bytes written to conn
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+// read from buf
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func cryptPair(t *testing.T, pskC []byte, pskS []byte) ([]byte, []byte, []byte, []byte) {
+	privC, pubC, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privS, pubS, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rC, wC, err := deriveKeys(privC, pubS, pskC, "token", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rS, wS, err := deriveKeys(privS, pubC, pskS, "token", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rC, wC, rS, wS
+}
+
+func TestDeriveKeys(t *testing.T) {
+	psk := []byte("secret")
+	rC, wC, rS, wS := cryptPair(t, psk, psk)
+	if !bytes.Equal(wC, rS) || !bytes.Equal(wS, rC) {
+		t.Fatal("client and server key not match")
+	}
+	if bytes.Equal(rC, wC) {
+		t.Fatal("same key for both direction")
+	}
+	if len(rC) != 32 {
+		t.Fatalf("key length %d", len(rC))
+	}
+
+	rC, wC, rS, wS = cryptPair(t, psk, []byte("other"))
+	if bytes.Equal(wC, rS) || bytes.Equal(wS, rC) {
+		t.Fatal("key match with different PSK")
+	}
+
+	priv, _, _ := newKeyPair()
+	for _, pub := range []string{"", "!!!", "AAAA"} {
+		if _, _, err := deriveKeys(priv, pub, psk, "token", true); err == nil {
+			t.Errorf("bad public key %q accepted", pub)
+		}
+	}
+}
+
+// token bind keys to this tunnel
+func TestDeriveKeysToken(t *testing.T) {
+	privC, pubC, _ := newKeyPair()
+	privS, pubS, _ := newKeyPair()
+	_, wC, _ := deriveKeys(privC, pubS, nil, "token1", true)
+	rS, _, _ := deriveKeys(privS, pubC, nil, "token2", false)
+	if bytes.Equal(wC, rS) {
+		t.Fatal("key match with different token")
+	}
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	rC, wC, rS, wS := cryptPair(t, nil, nil)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client, _ := newCryptConn(c1, rC, wC)
+	server, _ := newCryptConn(c2, rS, wS)
+
+	msgs := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("x"), cryptMaxRecord),
+		bytes.Repeat([]byte("y"), 3 * cryptMaxRecord + 7), // split to records
+		[]byte("bye"),
+	}
+	go func() {
+		for _, m := range msgs {
+			client.Write(m)
+		}
+	}()
+	for _, m := range msgs {
+		buf := make([]byte, len(m))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, m) {
+			t.Fatalf("data mismatch, len %d", len(m))
+		}
+	}
+
+	go server.Write([]byte("reply"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "reply" {
+		t.Fatalf("reply: %q %v", buf, err)
+	}
+}
+
+// records written by client, for tamper test
+func cryptRecords(t *testing.T, wKey []byte, msgs ...string) ([][]byte) {
+	rc := &recordConn{}
+	conn, err := newCryptConn(rc, wKey, wKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list [][]byte
+	for _, m := range msgs {
+		conn.Write([]byte(m))
+		list = append(list, append([]byte(nil), rc.buf.Bytes()...))
+		rc.buf.Reset()
+	}
+	return list
+}
+
+func readCrypt(t *testing.T, rKey []byte, data []byte) ([]byte, error) {
+	conn, _ := newCryptConn(&replayConn{r: bytes.NewReader(data)}, rKey, rKey)
+	return io.ReadAll(conn)
+}
+
+func TestCryptTamper(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	rec := cryptRecords(t, key, "hello world")[0]
+
+	if out, err := readCrypt(t, key, rec); err != nil || string(out) != "hello world" {
+		t.Fatalf("valid record: %q %v", out, err)
+	}
+	for i := range rec {
+		b := append([]byte(nil), rec...)
+		b[i] ^= 1
+		if out, err := readCrypt(t, key, b); err == nil || err == io.EOF {
+			t.Fatalf("tampered byte %d accepted: %q", i, out)
+		}
+	}
+	if _, err := readCrypt(t, bytes.Repeat([]byte{2}, 32), rec); err == nil {
+		t.Fatal("record opened with other key")
+	}
+}
+
+func TestCryptTruncate(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	rec := cryptRecords(t, key, "hello world")[0]
+
+	for _, n := range []int{1, 2, 10, len(rec) - 1} {
+		if _, err := readCrypt(t, key, rec[:n]); err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated to %d: err %v", n, err)
+		}
+	}
+
+	// length shorter than GCM tag
+	short := []byte{0, 4, 1, 2, 3, 4}
+	if _, err := readCrypt(t, key, short); err == nil || err == io.EOF {
+		t.Error("short record accepted")
+	}
+	binary.BigEndian.PutUint16(short, 0)
+	if _, err := readCrypt(t, key, short[:2]); err == nil || err == io.EOF {
+		t.Error("empty record accepted")
+	}
+}
+
+// nonce is record counter, replay or reorder fail
+func TestCryptNonce(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	recs := cryptRecords(t, key, "one", "two")
+
+	if out, err := readCrypt(t, key, append(append([]byte(nil), recs[0]...), recs[1]...)); err != nil || string(out) != "onetwo" {
+		t.Fatalf("in order: %q %v", out, err)
+	}
+	if _, err := readCrypt(t, key, append(append([]byte(nil), recs[1]...), recs[0]...)); err == nil {
+		t.Fatal("reordered record accepted")
+	}
+	if _, err := readCrypt(t, key, append(append([]byte(nil), recs[0]...), recs[0]...)); err == nil {
+		t.Fatal("replayed record accepted")
+	}
+	if _, err := readCrypt(t, key, recs[1]); err == nil {
+		t.Fatal("dropped first record not detected")
+	}
+}
@@ -0,0 +1,249 @@
+package fakehttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	decoyCacheSize = 256
+	decoyCacheMaxBody = 1024 * 1024
+)
+
+var cookieDomainRe = regexp.MustCompile(`(?i);\s*domain=[^;]*`)
+
+// reverse proxy to a real site as decoy, look like a copy of it
+type ProxyDecoy struct {
+	Upstream     *url.URL
+	Host         string // Host header to upstream, empty for host of Upstream
+	DropCookies  []string // cookies not sent to upstream, eg: tunnel token
+	DropHeaders  []string // request headers not sent to upstream
+	DropResp     []string // response headers not sent to client
+	CacheTTL     time.Duration // 0 to disable
+	CacheSize    int // max cached response
+	CacheMaxBody int64
+
+	proxy        *httputil.ReverseProxy
+
+	mx           sync.Mutex
+	cache        map[string]*cachedResp
+}
+
+type cachedResp struct {
+	status   int
+	header   http.Header
+	body     []byte
+	stored   time.Time
+	ttl      time.Time
+}
+
+func NewProxyDecoy(upstream string) (*ProxyDecoy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	d := &ProxyDecoy{
+		Upstream: u,
+		DropHeaders: []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip", "Forwarded", "Via", "Cf-Connecting-Ip"},
+		DropResp: []string{"Alt-Svc", "Via", "X-Served-By", "X-Cache", "X-Cache-Hits"},
+		CacheSize: decoyCacheSize,
+		CacheMaxBody: decoyCacheMaxBody,
+		cache: make(map[string]*cachedResp),
+	}
+	d.proxy = &httputil.ReverseProxy{
+		Director: d.director,
+		ModifyResponse: d.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			Vlogln(2, "decoy upstream err:", r.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return d, nil
+}
+
+type cacheKeyCtx struct{}
+
+func (d *ProxyDecoy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Del("Server") // upstream's own, not -hdsrv
+	if d.CacheTTL > 0 && r.Method == "GET" {
+		r = r.WithContext(context.WithValue(r.Context(), cacheKeyCtx{}, r.URL.RequestURI() + "|" + r.Header.Get("Accept-Encoding")))
+	}
+	if c := d.getCache(r); c != nil {
+		header := w.Header()
+		for k, v := range c.header {
+			header[k] = v
+		}
+		c.fresh(header, time.Now())
+		w.WriteHeader(c.status)
+		w.Write(c.body)
+		return
+	}
+	d.proxy.ServeHTTP(w, r)
+}
+
+func (d *ProxyDecoy) director(req *http.Request) {
+	req.URL.Scheme = d.Upstream.Scheme
+	req.URL.Host = d.Upstream.Host
+	if d.Upstream.Path != "" && d.Upstream.Path != "/" {
+		req.URL.Path = strings.TrimSuffix(d.Upstream.Path, "/") + req.URL.Path
+		req.URL.RawPath = ""
+	}
+	req.Host = d.Upstream.Host
+	if d.Host != "" {
+		req.Host = d.Host
+	}
+
+	for _, k := range d.DropHeaders {
+		req.Header[http.CanonicalHeaderKey(k)] = nil // nil to stop ReverseProxy add X-Forwarded-For
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "") // not Go's default
+	}
+
+	if len(d.DropCookies) > 0 {
+		var list []string
+		for _, c := range req.Cookies() {
+			if !hasName(d.DropCookies, c.Name) {
+				list = append(list, c.Name + "=" + c.Value)
+			}
+		}
+		req.Header.Del("Cookie")
+		if len(list) > 0 {
+			req.Header.Set("Cookie", strings.Join(list, "; "))
+		}
+	}
+}
+
+func (d *ProxyDecoy) modifyResponse(res *http.Response) (error) {
+	header := res.Header
+	for _, k := range d.DropResp {
+		header.Del(k)
+	}
+
+	// redirect to upstream should stay on us
+	if loc, err := url.Parse(header.Get("Location")); err == nil && loc.Host != "" {
+		if loc.Host == d.Upstream.Host || loc.Host == d.Host {
+			loc.Scheme, loc.Host = "", ""
+			header.Set("Location", loc.String())
+		}
+	}
+
+	// cookie for upstream domain will be rejected by browser
+	if cookies := header["Set-Cookie"]; len(cookies) > 0 {
+		for i, c := range cookies {
+			cookies[i] = cookieDomainRe.ReplaceAllString(c, "")
+		}
+	}
+
+	if d.cacheable(res) {
+		buf, err := ioutil.ReadAll(io.LimitReader(res.Body, d.CacheMaxBody + 1))
+		if err != nil {
+			return err
+		}
+		if int64(len(buf)) <= d.CacheMaxBody {
+			res.Body.Close()
+			res.Body = ioutil.NopCloser(bytes.NewReader(buf))
+			d.putCache(res, buf)
+		} else {
+			res.Body = CloseableReader{ io.MultiReader(bytes.NewReader(buf), res.Body), res.Body }
+		}
+	}
+	return nil
+}
+
+// set by ServeHTTP, before path rewritten
+func (d *ProxyDecoy) cacheKey(r *http.Request) (string) {
+	key, _ := r.Context().Value(cacheKeyCtx{}).(string)
+	return key
+}
+
+func (d *ProxyDecoy) cacheable(res *http.Response) (bool) {
+	if res.Request == nil || d.cacheKey(res.Request) == "" {
+		return false
+	}
+	if res.StatusCode != http.StatusOK || len(res.Header["Set-Cookie"]) > 0 {
+		return false
+	}
+	for _, v := range strings.Split(strings.Join(res.Header["Vary"], ","), ",") { // Accept-Encoding already in key
+		if v = strings.TrimSpace(v); v != "" && !strings.EqualFold(v, "Accept-Encoding") {
+			return false
+		}
+	}
+	cc := strings.ToLower(res.Header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+func (d *ProxyDecoy) getCache(r *http.Request) (*cachedResp) {
+	key := d.cacheKey(r)
+	if key == "" {
+		return nil
+	}
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	c, ok := d.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(c.ttl) {
+		delete(d.cache, key)
+		return nil
+	}
+	return c
+}
+
+func (d *ProxyDecoy) putCache(res *http.Response, body []byte) {
+	now := time.Now()
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if len(d.cache) >= d.CacheSize {
+		for k, c := range d.cache {
+			if now.After(c.ttl) {
+				delete(d.cache, k)
+			}
+		}
+	}
+	if len(d.cache) >= d.CacheSize {
+		for k := range d.cache { // random one
+			delete(d.cache, k)
+			break
+		}
+	}
+	d.cache[d.cacheKey(res.Request)] = &cachedResp{
+		status: res.StatusCode,
+		header: res.Header.Clone(),
+		body: body,
+		stored: now,
+		ttl: now.Add(d.CacheTTL),
+	}
+}
+
+// Date of this answer, Age as a shared cache would, not replay upstream's
+func (c *cachedResp) fresh(header http.Header, now time.Time) {
+	age, _ := strconv.ParseInt(c.header.Get("Age"), 10, 64)
+	if age < 0 {
+		age = 0
+	}
+	age += int64(now.Sub(c.stored) / time.Second)
+	header.Set("Date", now.UTC().Format(http.TimeFormat))
+	header.Set("Age", strconv.FormatInt(age, 10))
+}
+
+func hasName(list []string, name string) (bool) {
+	for _, v := range list {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package fakehttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestDecoy(t *testing.T, h http.HandlerFunc) (*ProxyDecoy, func()) {
+	up := httptest.NewServer(h)
+	d, err := NewProxyDecoy(up.URL)
+	if err != nil {
+		up.Close()
+		t.Fatal(err)
+	}
+	return d, up.Close
+}
+
+func decoyGet(d *ProxyDecoy, path string, header http.Header) (*httptest.ResponseRecorder) {
+	r := httptest.NewRequest("GET", path, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	w.Header().Set("Server", "nginx") // set by handleBase
+	d.ServeHTTP(w, r)
+	return w
+}
+
+func TestDecoyServer(t *testing.T) {
+	d, stop := newTestDecoy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream/1.0")
+		w.Header().Set("Via", "1.1 cache")
+	})
+	defer stop()
+	d.CacheTTL = time.Minute
+
+	for i := 0; i < 2; i++ { // upstream, then cache
+		w := decoyGet(d, "/", nil)
+		if got := w.Header()["Server"]; len(got) != 1 || got[0] != "upstream/1.0" {
+			t.Errorf("#%d Server: %q", i, got)
+		}
+		if w.Header().Get("Via") != "" {
+			t.Errorf("#%d Via not dropped", i)
+		}
+	}
+}
+
+func TestDecoyCacheVary(t *testing.T) {
+	hits := 0
+	d, stop := newTestDecoy(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		switch r.URL.Path {
+		case "/lang":
+			w.Header().Set("Vary", "Accept-Encoding, Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+		case "/gz":
+			w.Header().Set("Vary", "Accept-Encoding")
+			w.Write([]byte("gz"))
+		case "/private":
+			w.Header().Set("Cache-Control", "private")
+		}
+	})
+	defer stop()
+	d.CacheTTL = time.Minute
+
+	decoyGet(d, "/lang", http.Header{"Accept-Language": {"en"}})
+	w := decoyGet(d, "/lang", http.Header{"Accept-Language": {"fr"}})
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "fr" || hits != 2 {
+		t.Fatalf("Vary response cached: %q, hits %d", body, hits)
+	}
+
+	hits = 0
+	decoyGet(d, "/gz", nil)
+	decoyGet(d, "/gz", nil)
+	decoyGet(d, "/gz", http.Header{"Accept-Encoding": {"gzip"}})
+	if hits != 2 {
+		t.Fatalf("Vary: Accept-Encoding hits %d, want 2", hits)
+	}
+
+	hits = 0
+	decoyGet(d, "/private", nil)
+	decoyGet(d, "/private", nil)
+	if hits != 2 {
+		t.Fatalf("private response cached, hits %d", hits)
+	}
+}
+
+func TestDecoyDropCookies(t *testing.T) {
+	var got string
+	d, stop := newTestDecoy(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Cookie")
+	})
+	defer stop()
+	d.DropCookies = []string{"tk"}
+
+	decoyGet(d, "/", http.Header{"Cookie": {"tk=1; site=2"}})
+	if got != "site=2" {
+		t.Fatalf("Cookie to upstream: %q", got)
+	}
+}
+
+func TestDecoyCacheDate(t *testing.T) {
+	old := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	d, stop := newTestDecoy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", old)
+		w.Header().Set("Age", "5")
+	})
+	defer stop()
+	d.CacheTTL = time.Minute
+
+	decoyGet(d, "/", nil)
+	w := decoyGet(d, "/", nil) // from cache
+	date, err := http.ParseTime(w.Header().Get("Date"))
+	if err != nil || time.Since(date) > 5 * time.Second {
+		t.Errorf("cache hit Date %q, want now", w.Header().Get("Date"))
+	}
+	if got := w.Header().Get("Age"); got != "5" && got != "6" {
+		t.Errorf("cache hit Age %q, want 5", got)
+	}
+
+	// time in cache add to Age
+	c := &cachedResp{header: http.Header{"Age": {"5"}}, stored: time.Now().Add(-10 * time.Second)}
+	h := http.Header{}
+	c.fresh(h, time.Now())
+	if got := h.Get("Age"); got != "15" {
+		t.Errorf("Age %q, want 15", got)
+	}
+	if c.header.Get("Age") != "5" {
+		t.Errorf("stored Age changed: %q", c.header.Get("Age"))
+	}
+}
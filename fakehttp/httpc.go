@@ -2,16 +2,26 @@ package fakehttp
 
 import (
 	"bufio"
+	"crypto/ecdh"
 	"errors"
+	"math/rand"
 	"net"
 	"net/http"
 	"io/ioutil"
+	"sync"
 	"time"
 )
 
 var (
 	ErrNotServer       = errors.New("may not tunnel server")
 	ErrTokenTimeout    = errors.New("token may timeout")
+	ErrBadResponse     = errors.New("unexpected response, may be changed by middlebox")
+	ErrShareAfterDial  = errors.New("Share() after Dial()")
+)
+
+const (
+	ModeWs   = "ws" // 1 websocket connection
+	ModeHttp = "http" // 2 http connections, Tx & Rx
 )
 
 type NetDialer interface {
@@ -20,7 +30,7 @@ type NetDialer interface {
 	DialTimeout(host string, timeout time.Duration) (net.Conn, error) // net.DialTimeout("tcp", Host, Timeout)
 }
 
-type dialNonTLS Client
+type dialNonTLS struct{}
 func (dl dialNonTLS) GetProto() (string) {
 	return "http://"
 }
@@ -42,20 +52,90 @@ type Client struct {
 	TokenCookieA  string
 	TokenCookieB  string
 	TokenCookieC  string
-	UserAgent     string
+	KeyCookie     string // cookie carry public key for Encrypt
+	ShapeCookie   string // cookie ask for Shape
+	CompCookie    string // cookie ask for Compress
+	UserAgent     string // without Profiles
 	Url           string
 	Timeout       time.Duration
-	Host          string
+	Host          string // HTTP Host header, also default for Addr & ServerName
+	Addr          string // TCP address to dial, empty for Host
+	ServerName    string // TLS SNI, empty for hostname of Host
 	UseWs         bool
+	AutoMode      bool // try ws then http mode, remember which works
+	Compress      bool // compress upload, and ask server to compress download; http mode not with Encrypt or Shape
+	Encrypt       bool // end-to-end encrypt tunnel, key exchange in cookie, no MITM protection without PSK
+	Shape         bool // pad and jitter tunnel if server accept
+	ShapeBudget   float64 // max padding / data ratio
+	ShapeJitter   time.Duration // max random delay before each app write
+
+	TokenTTL      time.Duration // server's TokenTTL for Prefetch
+	Prefetch      int // keep tokens fetched in background, 0 to disable
+	PSK           []byte // pre-shared key to make token without GET, same as server
+
+	Jar           http.CookieJar // cookies set by site, send back like browser, nil to disable (default)
+	Cover         bool // also fetch css/js/img linked by page
+	CoverInterval time.Duration // revisit page at random time around this, 0 to disable
+
+	Profiles      []*Profile // browsers to mimic, pick one for each session
+	RotateUA      time.Duration // session length, 0 to keep first one
 
 	Dialer        NetDialer
+
+	shareMx       sync.Mutex
+	tokens        *tokenCache // may shared by Share(), nil until first use
+	dialed        bool
+
+	modeMx        sync.Mutex
+	mode          string
+
+	coverOnce     sync.Once
+
+	profMx        sync.Mutex
+	prof          *Profile
+	profExp       time.Time
 }
 
 func (cl *Client) getURL() (string) {
-	url := cl.Host + cl.Url
+	url := cl.getAddr() + cl.Url
 	return cl.Dialer.GetProto() + url
 }
 
+func (cl *Client) getOrigin() (string) {
+	return cl.Dialer.GetProto() + cl.Host
+}
+
+// same Profile for a session, pick another after RotateUA
+func (cl *Client) getProfile() (*Profile) {
+	if len(cl.Profiles) == 0 {
+		return nil
+	}
+
+	cl.profMx.Lock()
+	defer cl.profMx.Unlock()
+	now := time.Now()
+	if cl.prof == nil || (cl.RotateUA > 0 && now.After(cl.profExp)) {
+		cl.prof = cl.Profiles[rand.Intn(len(cl.Profiles))]
+		cl.profExp = now.Add(cl.RotateUA)
+		Vlogln(3, "profile:", cl.prof.Name)
+	}
+	return cl.prof
+}
+
+func (cl *Client) getAddr() (string) {
+	if cl.Addr != "" {
+		return cl.Addr
+	}
+	return cl.Host
+}
+
+func (cl *Client) getServerName() (string) {
+	if cl.ServerName != "" {
+		return cl.ServerName
+	}
+	return hostOnly(cl.Host)
+}
+
 func (cl *Client) getToken() (string, error) {
 	req, err := http.NewRequest("GET", cl.getURL(), nil)
 	if err != nil {
@@ -64,24 +144,58 @@ func (cl *Client) getToken() (string, error) {
 	}
 
 	req.Header.Set("User-Agent", cl.UserAgent)
+	if cookie := cl.jarCookie(); cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	req.Host = cl.Host
 	req.Close = true
-	res, err := cl.Dialer.Do(req, cl.Timeout)
+	res, err := cl.do(req, func(p *Profile) ([]string) { return p.Page })
 	if err != nil {
 		Vlogln(2, "getToken() send Request err:", err)
 		return "", err
 	}
 	defer res.Body.Close()
+	cl.saveCookie(res)
 
-	_, err = ioutil.ReadAll(res.Body)
+	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		Vlogln(2, "getToken() ReadAll err:", err)
 	}
 
 	Vlogln(3, "getToken() http version:", res.Proto)
+	if cl.Cover && err == nil {
+		go cl.fetchAssets(res, body)
+	}
 
 	return cl.checkToken(res)
 }
 
+// http.Client can not keep header order, write request by self with Profile
+func (cl *Client) do(req *http.Request, order func(*Profile) ([]string)) (*http.Response, error) {
+	p := cl.getProfile()
+	if p == nil {
+		return cl.Dialer.Do(req, cl.Timeout)
+	}
+
+	conn, err := cl.Dialer.DialTimeout(cl.getAddr(), cl.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(cl.Timeout))
+	err = p.write(conn, req, order(p), cl.getOrigin())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body = CloseableReader{ res.Body, conn }
+	return res, nil
+}
+
 func (cl *Client) checkToken(res *http.Response) (string, error) {
 	cookies := res.Cookies()
 	Vlogln(3, "checkToken()", cookies)
@@ -96,7 +210,30 @@ func (cl *Client) checkToken(res *http.Response) (string, error) {
 	return  "", ErrNotServer
 }
 
-func (cl *Client) getTx(token string) (net.Conn, []byte, error) { //io.WriteCloser
+func (cl *Client) mkCookie(token string, flag string, method string, ext string) (string) {
+	cookie := cl.TokenCookieB + "=" + token + "; " + cl.TokenCookieC + "=" + mkFlag(flag, cl.PSK, token, method) + ext
+	if jar := cl.jarCookie(cl.TokenCookieB, cl.TokenCookieC, cl.KeyCookie, cl.ShapeCookie, cl.CompCookie); jar != "" {
+		cookie = jar + "; " + cookie
+	}
+	return cookie
+}
+
+// cookies for Encrypt, Shape & Compress, same on each leg
+func (cl *Client) extCookie(pub string) (string) {
+	ext := ""
+	if pub != "" {
+		ext += "; " + cl.KeyCookie + "=" + pub
+	}
+	if cl.Shape {
+		ext += "; " + cl.ShapeCookie + "=" + randStringBytes(16)
+	}
+	if cl.Compress {
+		ext += "; " + cl.CompCookie + "=" + randStringBytes(16)
+	}
+	return ext
+}
+
+func (cl *Client) getTx(token string, ext string, p *Profile) (net.Conn, []byte, error) { //io.WriteCloser
 
 	req, err := http.NewRequest(cl.TxMethod, cl.getURL(), nil)
 	if err != nil {
@@ -105,23 +242,31 @@ func (cl *Client) getTx(token string) (net.Conn, []byte, error) { //io.WriteClos
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Content-Encoding", "gzip")
+	if cl.gzipLeg() {
+		req.Header.Set("Content-Encoding", codecGzip)
+	}
 	req.Header.Set("Pragma", "no-cache")
 	req.Header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
 	req.Header.Set("User-Agent", cl.UserAgent)
-	req.Header.Set("Cookie", cl.TokenCookieB + "=" + token + "; " + cl.TokenCookieC + "=" + cl.TxFlag)
+	req.Host = cl.Host
+	req.Header.Set("Cookie", cl.mkCookie(token, cl.TxFlag, cl.TxMethod, ext))
 
-	tx, err := cl.Dialer.DialTimeout(cl.Host, cl.Timeout)
+	tx, err := cl.Dialer.DialTimeout(cl.getAddr(), cl.Timeout)
 	if err != nil {
-		Vlogln(2, "Tx connect to:", cl.Host, err)
+		Vlogln(2, "Tx connect to:", cl.getAddr(), err)
 		return nil, nil, err
 	}
 
-	Vlogln(3, "Tx connect ok:", cl.Host)
-	req.Write(tx)
+	Vlogln(3, "Tx connect ok:", cl.getAddr())
+	if p != nil {
+		p.write(tx, req, p.Post, cl.getOrigin())
+	} else {
+		req.Write(tx)
+	}
 
 	txbuf := bufio.NewReaderSize(tx, 1024)
 //	Vlogln(2, "Tx Reader", txbuf)
+	tx.SetReadDeadline(time.Now().Add(cl.Timeout)) // buffered by middlebox
 	res, err := http.ReadResponse(txbuf, req)
 	if err != nil {
 		Vlogln(2, "Tx ReadResponse", err, res)
@@ -135,6 +280,12 @@ func (cl *Client) getTx(token string) (net.Conn, []byte, error) { //io.WriteClos
 		tx.Close()
 		return nil, nil, ErrTokenTimeout
 	}
+	if res.StatusCode != http.StatusOK {
+		Vlogln(2, "Tx status:", res.Status)
+		tx.Close()
+		return nil, nil, ErrBadResponse
+	}
+	tx.SetReadDeadline(time.Time{})
 
 	n := txbuf.Buffered()
 	Vlogln(3, "Tx Response", n)
@@ -142,7 +293,8 @@ func (cl *Client) getTx(token string) (net.Conn, []byte, error) { //io.WriteClos
 	return tx, nil, nil
 }
 
-func (cl *Client) getRx(token string) (net.Conn, []byte, error) { //io.ReadCloser
+// read tunnel from res.Body, chunked or not, may re-framed by middlebox
+func (cl *Client) getRx(token string, ext string, p *Profile) (net.Conn, *http.Response, error) { //io.ReadCloser
 
 	req, err := http.NewRequest(cl.RxMethod, cl.getURL(), nil)
 	if err != nil {
@@ -150,22 +302,31 @@ func (cl *Client) getRx(token string) (net.Conn, []byte, error) { //io.ReadClose
 		return nil, nil, err
 	}
 
+	if cl.Compress {
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
 	req.Header.Set("Pragma", "no-cache")
 	req.Header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
 	req.Header.Set("User-Agent", cl.UserAgent)
-	req.Header.Set("Cookie", cl.TokenCookieB + "=" + token + "; " + cl.TokenCookieC + "=" + cl.RxFlag)
+	req.Host = cl.Host
+	req.Header.Set("Cookie", cl.mkCookie(token, cl.RxFlag, cl.RxMethod, ext))
 
 
-	rx, err := cl.Dialer.DialTimeout(cl.Host, cl.Timeout)
+	rx, err := cl.Dialer.DialTimeout(cl.getAddr(), cl.Timeout)
 	if err != nil {
-		Vlogln(2, "Rx connect to:", cl.Host, err)
+		Vlogln(2, "Rx connect to:", cl.getAddr(), err)
 		return nil, nil, err
 	}
-	Vlogln(3, "Rx connect ok:", cl.Host)
-	req.Write(rx)
+	Vlogln(3, "Rx connect ok:", cl.getAddr())
+	if p != nil {
+		p.write(rx, req, p.Fetch, cl.getOrigin())
+	} else {
+		req.Write(rx)
+	}
 
 	rxbuf := bufio.NewReaderSize(rx, 1024)
 //	Vlogln(2, "Rx Reader", rxbuf)
+	rx.SetReadDeadline(time.Now().Add(cl.Timeout)) // buffered by middlebox
 	res, err := http.ReadResponse(rxbuf, req)
 	if err != nil {
 		Vlogln(2, "Rx ReadResponse", err, res, rxbuf)
@@ -179,16 +340,15 @@ func (cl *Client) getRx(token string) (net.Conn, []byte, error) { //io.ReadClose
 		rx.Close()
 		return nil, nil, ErrTokenTimeout
 	}
-
-	n := rxbuf.Buffered()
-	Vlogln(3, "Rx Response", n)
-	if n > 0 {
-		buf := make([]byte, n)
-		rxbuf.Read(buf[:n])
-		return rx, buf[:n], nil
-	} else {
-		return rx, nil, nil
+	if res.StatusCode != http.StatusOK {
+		Vlogln(2, "Rx status:", res.Status)
+		rx.Close()
+		return nil, nil, ErrBadResponse
 	}
+	rx.SetReadDeadline(time.Time{})
+
+	Vlogln(3, "Rx Response", res.TransferEncoding, res.ContentLength)
+	return rx, res, nil
 }
 
 
@@ -201,29 +361,131 @@ func NewClient(target string) (*Client) {
 		TokenCookieA: tokenCookieA,
 		TokenCookieB: tokenCookieB,
 		TokenCookieC: tokenCookieC,
+		KeyCookie: keyCookie,
+		ShapeCookie: shapeCookie,
+		CompCookie: compCookie,
+		ShapeBudget: shapeBudget,
 		UserAgent:    userAgent,
 		Url:          targetUrl,
 		Timeout:      timeout,
 		Host:         target,
 		UseWs:        false,
+		TokenTTL:     tokenTTL,
 	}
-	cl.Dialer = dialNonTLS(*cl)
+	cl.Dialer = dialNonTLS{}
 	return cl
 }
 
+// use token cache, cookies and TLS sessions of o, for other path or mode on same server
+// must call before first Dial()
+func (cl *Client) Share(o *Client) (error) {
+	tc := o.tokenCache()
+
+	cl.shareMx.Lock()
+	defer cl.shareMx.Unlock()
+	if cl.dialed {
+		return ErrShareAfterDial
+	}
+	cl.tokens = tc
+	cl.Jar = o.Jar
+	shareTLS(cl.Dialer, o.Dialer)
+	return nil
+}
+
+// create on first use, Client may not from NewClient()
+func (cl *Client) tokenCache() (*tokenCache) {
+	cl.shareMx.Lock()
+	defer cl.shareMx.Unlock()
+	if cl.tokens == nil {
+		cl.tokens = &tokenCache{}
+	}
+	return cl.tokens
+}
+
 func Dial(target string) (net.Conn, error) {
 	cl := NewClient(target)
 	return cl.Dial()
 }
 
 func (cl *Client) Dial() (net.Conn, error) {
-	token, err := cl.getToken()
-	if token == "" || err != nil {
-		return nil, err
+	cl.shareMx.Lock()
+	cl.dialed = true
+	cl.shareMx.Unlock()
+
+	if cl.CoverInterval > 0 {
+		cl.startCover()
+	}
+
+	if !cl.AutoMode {
+		mode := ModeHttp
+		if cl.UseWs {
+			mode = ModeWs
+		}
+		token, err := cl.dialToken()
+		if err != nil {
+			return nil, err
+		}
+		return cl.dialMode(token, mode)
+	}
+
+	var err error
+	for _, mode := range cl.autoModes() {
+		// server not reachable, no need to try other mode
+		var token string
+		token, err = cl.dialToken()
+		if err != nil {
+			return nil, err
+		}
+
+		var conn net.Conn
+		conn, err = cl.dialMode(token, mode)
+		if err == nil {
+			cl.setMode(mode)
+			return conn, nil
+		}
+		Vlogln(2, "mode:", mode, "fail:", err)
+	}
+	return nil, err
+}
+
+// mode of last success tunnel
+func (cl *Client) Mode() (string) {
+	cl.modeMx.Lock()
+	defer cl.modeMx.Unlock()
+	return cl.mode
+}
+
+func (cl *Client) setMode(mode string) {
+	cl.modeMx.Lock()
+	defer cl.modeMx.Unlock()
+	if cl.mode != mode {
+		Vlogln(2, "server:", cl.Host, "use mode:", mode)
+	}
+	cl.mode = mode
+}
+
+// worked one first
+func (cl *Client) autoModes() ([]string) {
+	if cl.Mode() == ModeHttp {
+		return []string{ModeHttp, ModeWs}
+	}
+	return []string{ModeWs, ModeHttp}
+}
+
+func (cl *Client) dialToken() (string, error) {
+	token, err := cl.nextToken()
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", ErrNotServer
 	}
 	Vlogln(2, "token:", token)
+	return token, nil
+}
 
-	if cl.UseWs {
+func (cl *Client) dialMode(token string, mode string) (net.Conn, error) {
+	if mode == ModeWs {
 		return cl.dialWs(token)
 	}
 
@@ -231,6 +493,13 @@ func (cl *Client) Dial() (net.Conn, error) {
 }
 
 func (cl *Client) dialWs(token string) (net.Conn, error) {
+	priv, pub, err := cl.keyPair()
+	if err != nil {
+		return nil, err
+	}
+	ext := cl.extCookie(pub)
+	p := cl.getProfile()
+
 	req, err := http.NewRequest(cl.RxMethod, cl.getURL(), nil)
 	if err != nil {
 		Vlogln(2, "dialWs() NewRequest err:", err)
@@ -240,22 +509,29 @@ func (cl *Client) dialWs(token string) (net.Conn, error) {
 	req.Header.Set("Pragma", "no-cache")
 	req.Header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
 	req.Header.Set("User-Agent", cl.UserAgent)
-	req.Header.Set("Cookie", cl.TokenCookieB + "=" + token + "; " + cl.TokenCookieC + "=" + cl.RxFlag)
+	req.Host = cl.Host
+	req.Header.Set("Cookie", cl.mkCookie(token, cl.RxFlag, cl.RxMethod, ext))
 	req.Header.Set("Connection", "Upgrade")
 	req.Header.Set("Upgrade", "websocket")
 	req.Header.Set("Sec-WebSocket-Key", token)
 	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate") // as browser, not used
 
-	rx, err := cl.Dialer.DialTimeout(cl.Host, cl.Timeout)
+	rx, err := cl.Dialer.DialTimeout(cl.getAddr(), cl.Timeout)
 	if err != nil {
-		Vlogln(2, "WS connect to:", cl.Host, err)
+		Vlogln(2, "WS connect to:", cl.getAddr(), err)
 		return nil, err
 	}
-	Vlogln(3, "WS connect ok:", cl.Host)
-	req.Write(rx)
+	Vlogln(3, "WS connect ok:", cl.getAddr())
+	if p != nil {
+		p.write(rx, req, p.Ws, cl.getOrigin())
+	} else {
+		req.Write(rx)
+	}
 
 	rxbuf := bufio.NewReaderSize(rx, 1024)
 //	Vlogln(2, "Rx Reader", rxbuf)
+	rx.SetReadDeadline(time.Now().Add(cl.Timeout)) // buffered by middlebox
 	res, err := http.ReadResponse(rxbuf, req)
 	if err != nil {
 		Vlogln(2, "WS ReadResponse", err, res, rxbuf)
@@ -269,43 +545,63 @@ func (cl *Client) dialWs(token string) (net.Conn, error) {
 		rx.Close()
 		return nil, ErrTokenTimeout
 	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		Vlogln(2, "WS status:", res.Status)
+		rx.Close()
+		return nil, ErrBadResponse
+	}
+	rx.SetReadDeadline(time.Time{})
+
+	// both side compress if server accept
+	codec := ""
+	if cl.Compress && hasCookie(res, cl.CompCookie) {
+		codec = codecDeflate
+	}
 
+	var conn net.Conn = rx
 	n := rxbuf.Buffered()
 	Vlogln(3, "WS Response", n)
 	if n > 0 {
 		buf := make([]byte, n)
 		rxbuf.Read(buf[:n])
-		return mkconn(rx, rx, buf[:n]), nil
+		conn = mkconn(rx, rx, buf[:n])
 	}
 
-	return rx, nil
+	return cl.wrapConn(conn, res, priv, token, codec, codec)
 }
 
 func (cl *Client) dialNonWs(token string) (net.Conn, error) {
 	type ret struct {
 		conn  net.Conn
-		buf   []byte
+		res   *http.Response
 		err   error
 	}
+	priv, pub, err := cl.keyPair()
+	if err != nil {
+		return nil, err
+	}
+	ext := cl.extCookie(pub)
+	p := cl.getProfile()
+
 	txRetCh := make(chan ret, 1)
 	rxRetCh := make(chan ret, 1)
 
 	go func () {
-		tx, _, err := cl.getTx(token)
+		tx, _, err := cl.getTx(token, ext, p)
 		Vlogln(4, "tx:", tx)
 		txRetCh <- ret{tx, nil, err}
 	}()
 	go func () {
-		rx, rxbuf, err := cl.getRx(token)
-		Vlogln(4, "rx:", rx, rxbuf)
-		rxRetCh <- ret{rx, rxbuf, err}
+		rx, res, err := cl.getRx(token, ext, p)
+		Vlogln(4, "rx:", rx)
+		rxRetCh <- ret{rx, res, err}
 	}()
 
 	txRet := <-txRetCh
-	tx, _, txErr := txRet.conn, txRet.buf, txRet.err
+	tx, txErr := txRet.conn, txRet.err
 
 	rxRet := <-rxRetCh
-	rx, rxbuf, rxErr := rxRet.conn, rxRet.buf, rxRet.err
+	rx, res, rxErr := rxRet.conn, rxRet.res, rxRet.err
 
 	if txErr != nil {
 		if rx != nil { // close other side, no half open
@@ -321,7 +617,87 @@ func (cl *Client) dialNonWs(token string) (net.Conn, error) {
 		return nil, rxErr
 	}
 
-	return mkconn(rx, tx, rxbuf), nil
+	rxCodec := ""
+	if res.Header.Get("Content-Encoding") == codecGzip {
+		if !cl.gzipLeg() { // can not be outermost layer
+			Vlogln(2, "Rx gzip under encrypt/shape")
+			tx.Close()
+			rx.Close()
+			return nil, ErrBadResponse
+		}
+		rxCodec = codecGzip
+	}
+	txCodec := ""
+	if cl.gzipLeg() {
+		txCodec = codecGzip
+	}
+	conn := Conn{
+		R: CloseableReader{ res.Body, rx },
+		W: tx,
+	}
+	return cl.wrapConn(conn, res, priv, token, rxCodec, txCodec)
+}
+
+// http mode gzip must be outermost layer on wire, as Content-Encoding claim
+func (cl *Client) gzipLeg() (bool) {
+	return cl.Compress && !cl.Encrypt && !cl.Shape
+}
+
+func hasCookie(res *http.Response, name string) (bool) {
+	for _, c := range res.Cookies() {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// new key pair for each tunnel if Encrypt
+func (cl *Client) keyPair() (*ecdh.PrivateKey, string, error) {
+	if !cl.Encrypt {
+		return nil, "", nil
+	}
+	return newKeyPair()
+}
+
+// encrypt outside, shape, then compress, jitter on app write; never fallback to plaintext
+func (cl *Client) wrapConn(conn net.Conn, res *http.Response, priv *ecdh.PrivateKey, token string, rCodec string, wCodec string) (net.Conn, error) {
+	peerPub := ""
+	shape := false
+	for _, c := range res.Cookies() {
+		switch c.Name {
+		case cl.KeyCookie:
+			peerPub = c.Value
+		case cl.ShapeCookie:
+			shape = cl.Shape
+		}
+	}
+
+	if priv != nil {
+		if peerPub == "" {
+			conn.Close()
+			return nil, ErrNoKey
+		}
+		rKey, wKey, err := deriveKeys(priv, peerPub, cl.PSK, token, true)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		econn, err := newCryptConn(conn, rKey, wKey)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = econn
+	}
+	if shape {
+		conn = newShapeConn(conn, cl.ShapeBudget)
+	}
+	conn = newCompConn(conn, rCodec, wCodec)
+	if shape {
+		conn = newJitterConn(conn, cl.ShapeJitter)
+	}
+	return conn, nil
 }
 
 
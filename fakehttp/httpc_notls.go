@@ -0,0 +1,6 @@
+// +build notls
+
+package fakehttp
+
+func shareTLS(dst NetDialer, src NetDialer) {
+}
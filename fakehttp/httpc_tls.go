@@ -8,23 +8,42 @@ import (
 	"net"
 	"net/http"
 	"time"
-	"strings"
 )
 
 type dialTLS struct {
 	Transport     *http.Transport
 	TLSConfig     *tls.Config
+
+	cl            *Client
 }
 
 func (dl *dialTLS) GetProto() (string) {
 	return "https://"
 }
 
+// apply Client.ServerName, may change after NewTLSClient()
+func (dl *dialTLS) getConfig() (*tls.Config) {
+	serverName := dl.cl.getServerName()
+	if serverName == dl.TLSConfig.ServerName {
+		return dl.TLSConfig
+	}
+	cfg := dl.TLSConfig.Clone()
+	cfg.ServerName = serverName
+	return cfg
+}
+
 func (dl *dialTLS) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
 	client := &http.Client{
 		Timeout: timeout,
 	}
-	client.Transport = dl.Transport
+	cfg := dl.getConfig()
+	if cfg == dl.TLSConfig {
+		client.Transport = dl.Transport
+	} else {
+		tr := dl.Transport.Clone()
+		tr.TLSClientConfig = cfg
+		client.Transport = tr
+	}
 	return client.Do(req)
 }
 
@@ -33,19 +52,13 @@ func (dl *dialTLS) DialTimeout(host string, timeout time.Duration) (net.Conn, er
 	if err != nil {
 		return nil, err
 	}
-	tx = tls.Client(tx, dl.TLSConfig)
+	tx = tls.Client(tx, dl.getConfig())
 	return tx, nil
 }
 
 func NewTLSClient(target string, caCrtByte []byte, skipVerify bool) (*Client) {
 	cl := NewClient(target)
 
-	colonPos := strings.LastIndex(target, ":")
-	if colonPos == -1 {
-		colonPos = len(target)
-	}
-	hostname := target[:colonPos]
-
 	var caCrtPool *x509.CertPool
 	if caCrtByte != nil {
 		caCrtPool = x509.NewCertPool()
@@ -55,7 +68,8 @@ func NewTLSClient(target string, caCrtByte []byte, skipVerify bool) (*Client) {
 	TLSConfig := &tls.Config{
 		RootCAs: caCrtPool,
 		InsecureSkipVerify: skipVerify,
-		ServerName: hostname,
+		ServerName: cl.getServerName(),
+		ClientSessionCache: tls.NewLRUClientSessionCache(tlsSessionCacheSize), // resume on each new Tx/Rx connection
 	}
 
 	Transport := &http.Transport{
@@ -65,8 +79,21 @@ func NewTLSClient(target string, caCrtByte []byte, skipVerify bool) (*Client) {
 	cl.Dialer = &dialTLS{
 		TLSConfig: TLSConfig,
 		Transport: Transport,
+		cl: cl,
 	}
 
 	return cl
 }
 
+// same ClientSessionCache, resume session got by other
+func shareTLS(dst NetDialer, src NetDialer) {
+	d, ok := dst.(*dialTLS)
+	if !ok {
+		return
+	}
+	s, ok := src.(*dialTLS)
+	if !ok {
+		return
+	}
+	d.TLSConfig.ClientSessionCache = s.TLSConfig.ClientSessionCache
+}
@@ -0,0 +1,71 @@
+// +build !notls
+
+package fakehttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type seenReq struct {
+	host   string
+	sni    string
+	origin string
+}
+
+// dial Addr, but Host header & SNI by Host & ServerName
+func TestClientAddrHost(t *testing.T) {
+	var mx sync.Mutex
+	var seen []seenReq
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		seen = append(seen, seenReq{r.Host, r.TLS.ServerName, r.Header.Get("Origin")})
+		mx.Unlock()
+	}))
+	defer ts.Close()
+
+	for _, p := range []*Profile{nil, ProfileChrome} {
+		seen = nil
+		cl := NewTLSClient("site.test", nil, true)
+		cl.Addr = ts.Listener.Addr().String()
+		cl.ServerName = "sni.test"
+		if p != nil {
+			cl.Profiles = []*Profile{p}
+		}
+
+		cl.getToken() // no token from httptest, only check request
+		tx, _, err := cl.getTx("token", "", cl.getProfile())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Close()
+
+		if len(seen) != 2 {
+			t.Fatalf("profile %v: %d requests", p != nil, len(seen))
+		}
+		for i, s := range seen {
+			if s.host != "site.test" || s.sni != "sni.test" {
+				t.Errorf("profile %v #%d: Host %q SNI %q", p != nil, i, s.host, s.sni)
+			}
+		}
+		if p != nil && seen[1].origin != "https://site.test" {
+			t.Errorf("Origin %q", seen[1].origin)
+		}
+	}
+}
+
+func TestClientServerNameDefault(t *testing.T) {
+	cl := NewTLSClient("site.test:8443", nil, true)
+	if sni := cl.getServerName(); sni != "site.test" {
+		t.Fatalf("SNI %q", sni)
+	}
+	if addr := cl.getAddr(); addr != "site.test:8443" {
+		t.Fatalf("Addr %q", addr)
+	}
+	cl.Addr = "192.0.2.1:443"
+	if url := cl.getURL(); url != "https://192.0.2.1:443/" {
+		t.Fatalf("URL %q", url)
+	}
+}
@@ -2,9 +2,12 @@ package fakehttp
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/ecdh"
 	"errors"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,11 +23,44 @@ type Server struct {
 	die           chan struct{}
 	dieLock       sync.Mutex
 	states        map[string]*state
+	replay        *replayCache
+	ban           *banList
 	accepts       chan net.Conn
 	lis           net.Listener
 
 	cleanerStarted uint32
 
+	VHost // default for host not in VHosts
+	VHosts        map[string]*VHost // by lowercase Host or SNI without port
+	TokenTTL      time.Duration
+	PairTimeout   time.Duration // end unpaired http mode leg after, other leg of real client come at once
+
+	ReplayCacheSize int // max nonce remembered, each kept for TokenTTL, oldest dropped when full, <= 0 for unlimited
+	LegacyFlag      bool // also accept static TxFlag/RxFlag from old client, replayable
+
+	TrustedProxies []*net.IPNet // only trust IPHeader from these peers
+	IPHeader      string // header for client IP, must be one the proxy overwrite or append to: X-Forwarded-For, X-Real-IP, Forwarded, Cf-Connecting-Ip
+	BindIP        bool // Tx/Rx/WS must come from the address token issued to
+	BindPrefix4   int // IPv4 prefix length treated as same address
+	BindPrefix6   int // IPv6 prefix length treated as same address
+
+	Allow         []*net.IPNet // tunnel only from these, nil for any
+	Deny          []*net.IPNet // no tunnel from these
+	BanMaxFail    int // ban after fail times in BanFindTime, 0 to disable
+	BanFindTime   time.Duration
+	BanTime       time.Duration
+
+	PSK           []byte // pre-shared key, also accept token made by client
+	Compress      bool // compress download if client accept, upload always accepted; http mode not with Encrypt or Shape
+	Encrypt       bool // require end-to-end encryption, key exchange in cookie, no MITM protection without PSK
+	Shape         bool // pad and jitter tunnel if client ask
+	ShapeBudget   float64 // max padding / data ratio
+	ShapeJitter   time.Duration // max random delay before each app write
+}
+
+// settings can differ by Host or SNI
+type VHost struct {
+	Name          string // key in Server.VHosts, empty for default
 	TxMethod      string
 	RxMethod      string
 	TxFlag        string
@@ -32,19 +68,30 @@ type Server struct {
 	TokenCookieA  string
 	TokenCookieB  string
 	TokenCookieC  string
+	KeyCookie     string // cookie carry public key for Encrypt
+	ShapeCookie   string // cookie ask for Shape
+	CompCookie    string // cookie ask for Compress
 	HeaderServer  string
 	HttpHandler   http.Handler
 	UseWs         bool
 	OnlyWs        bool
-	TokenTTL      time.Duration
 }
 
 type state struct {
 	IP       string
+	host     string // VHost.Name token issued by
 	mx       sync.Mutex
+	dead     bool // paired or expired, no more leg accepted
 	connR    net.Conn
 	bufR     *bufio.ReadWriter
 	connW    net.Conn
+	codecR   string
+	codecW   string
+	priv     *ecdh.PrivateKey
+	pubC     string // client's public key, same on both leg
+	pubS     string
+	shape    bool
+	path     string // URL path of first leg
 	ttl      time.Time
 }
 
@@ -52,19 +99,33 @@ func NewServer(lis net.Listener) (*Server) {
 	srv := &Server{
 		lis: lis,
 		states: make(map[string]*state),
+		replay: newReplayCache(),
+		ban: newBanList(),
 		accepts: make(chan net.Conn, 128),
-		TxMethod:     txMethod,
-		RxMethod:     rxMethod,
-		TxFlag:       txFlag,
-		RxFlag:       rxFlag,
-		TokenCookieA: tokenCookieA,
-		TokenCookieB: tokenCookieB,
-		TokenCookieC: tokenCookieC,
-		HeaderServer: headerServer,
-		HttpHandler: http.FileServer(http.Dir("./www")),
-		UseWs: true,
-		OnlyWs: false,
+		VHost: VHost{
+			TxMethod:     txMethod,
+			RxMethod:     rxMethod,
+			TxFlag:       txFlag,
+			RxFlag:       rxFlag,
+			TokenCookieA: tokenCookieA,
+			TokenCookieB: tokenCookieB,
+			TokenCookieC: tokenCookieC,
+			KeyCookie:    keyCookie,
+			ShapeCookie:  shapeCookie,
+			CompCookie:   compCookie,
+			HeaderServer: headerServer,
+			HttpHandler:  defaultHandler(),
+			UseWs:        true,
+			OnlyWs:       false,
+		},
+		ShapeBudget: shapeBudget,
 		TokenTTL: tokenTTL,
+		PairTimeout: pairTimeout,
+		ReplayCacheSize: replayCacheSize,
+		BindPrefix4: 32,
+		BindPrefix6: 128,
+		BanFindTime: banFindTime,
+		BanTime: banTime,
 	}
 
 	return srv
@@ -73,19 +134,33 @@ func NewServer(lis net.Listener) (*Server) {
 func NewHandle(hdlr http.Handler) (*Server) {
 	srv := &Server{
 		states: make(map[string]*state),
+		replay: newReplayCache(),
+		ban: newBanList(),
 		accepts: make(chan net.Conn, 128),
-		TxMethod:     txMethod,
-		RxMethod:     rxMethod,
-		TxFlag:       txFlag,
-		RxFlag:       rxFlag,
-		TokenCookieA: tokenCookieA,
-		TokenCookieB: tokenCookieB,
-		TokenCookieC: tokenCookieC,
-		HeaderServer: headerServer,
-		HttpHandler: hdlr,
-		UseWs: true,
-		OnlyWs: false,
+		VHost: VHost{
+			TxMethod:     txMethod,
+			RxMethod:     rxMethod,
+			TxFlag:       txFlag,
+			RxFlag:       rxFlag,
+			TokenCookieA: tokenCookieA,
+			TokenCookieB: tokenCookieB,
+			TokenCookieC: tokenCookieC,
+			KeyCookie:    keyCookie,
+			ShapeCookie:  shapeCookie,
+			CompCookie:   compCookie,
+			HeaderServer: headerServer,
+			HttpHandler:  hdlr,
+			UseWs:        true,
+			OnlyWs:       false,
+		},
+		ShapeBudget: shapeBudget,
 		TokenTTL: tokenTTL,
+		PairTimeout: pairTimeout,
+		ReplayCacheSize: replayCacheSize,
+		BindPrefix4: 32,
+		BindPrefix6: 128,
+		BanFindTime: banFindTime,
+		BanTime: banTime,
 	}
 
 	srv.startTokenCleaner()
@@ -151,14 +226,23 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var ok bool
 	var err error
 	var c, ct *http.Cookie
+	var flag string
+	var ip string
+	vh := srv.vhost(r)
 
-	c, err = r.Cookie(srv.TokenCookieB) // token
+	c, err = r.Cookie(vh.TokenCookieB) // token
 	if err != nil {
 		Vlogln(3, "cookieB err:", c, err)
 		goto FILE
 	}
 
-	ct, err = r.Cookie(srv.TokenCookieC) // flag
+	ip = srv.clientIP(r)
+	if !srv.tunnelAllowed(ip) {
+		Vlogln(3, "tunnel not allowed:", ip)
+		goto FILE
+	}
+
+	ct, err = r.Cookie(vh.TokenCookieC) // flag
 	if err != nil {
 		Vlogln(3, "cookieC err:", ct, err)
 		goto FILE
@@ -166,136 +250,454 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	Vlogln(3, "cookieC ok:", ct)
 
 	cc, ok = srv.checkToken(c.Value)
-	if ok {
-		if r.Method == srv.RxMethod || r.Method == srv.TxMethod {
-			Vlogln(2, "req check:", c.Value)
-		} else {
+	if !ok && srv.PSK != nil {
+		cc, ok = srv.checkPSKToken(c.Value, ip, vh.Name)
+	}
+	if !ok {
+		srv.fail(ip, "unknown token: " + c.Value)
+	} else {
+		Vlogln(2, "req check:", c.Value)
+
+		if cc.host != vh.Name {
+			Vlogln(2, "token host mismatch:", c.Value, cc.host, vh.Name)
+			srv.fail(ip, "token host mismatch")
 			goto FILE
 		}
 
-		if srv.OnlyWs {
-			srv.handleWs(w, r, c.Value, ct.Value, cc)
-			return
-		} else {
-			// check ws or not
-			if !srv.UseWs {
-				srv.handleNonWs(w, r, c.Value, ct.Value, cc)
-				return
-			} else {
-				if r.Header.Get("Upgrade") == "websocket" && r.Header.Get("Sec-WebSocket-Key") == c.Value {
-					srv.handleWs(w, r, c.Value, ct.Value, cc)
-					return
-				}
+		if srv.BindIP && !sameNet(cc.IP, ip, srv.BindPrefix4, srv.BindPrefix6) {
+			Vlogln(2, "token address mismatch:", c.Value, cc.IP, ip)
+			srv.fail(ip, "token address mismatch")
+			goto FILE
+		}
+
+		flag, ok = srv.checkFlag(vh, ct.Value, c.Value, r.Method)
+		if !ok {
+			srv.fail(ip, "flag mismatch")
+			goto FILE
+		}
 
-				srv.handleNonWs(w, r, c.Value, ct.Value, cc)
+		// anything not a valid tunnel request looks like normal web request
+		isWs := r.Header.Get("Upgrade") == "websocket" && r.Header.Get("Sec-WebSocket-Key") == c.Value
+		if isWs && vh.UseWs {
+			if srv.handleWs(w, r, vh, c.Value, flag, cc) {
+				return
+			}
+		}
+		if !isWs && !vh.OnlyWs {
+			if srv.handleNonWs(w, r, vh, c.Value, flag, cc) {
 				return
 			}
 		}
 	}
 
 FILE:
-	srv.handleBase(w,r)
+	srv.handleBase(w, r, vh)
+}
+
+// config by Host, then SNI
+func (srv *Server) vhost(r *http.Request) (*VHost) {
+	if len(srv.VHosts) > 0 {
+		if vh, ok := srv.VHosts[strings.ToLower(hostOnly(r.Host))]; ok {
+			return vh
+		}
+		if r.TLS != nil {
+			if vh, ok := srv.VHosts[strings.ToLower(r.TLS.ServerName)]; ok {
+				return vh
+			}
+		}
+	}
+	return &srv.VHost
+}
+
+// copy of default settings, register for names
+func (srv *Server) NewVHost(names ...string) (*VHost) {
+	vh := srv.VHost
+	if len(names) > 0 {
+		vh.Name = strings.ToLower(names[0])
+	}
+	if srv.VHosts == nil {
+		srv.VHosts = make(map[string]*VHost)
+	}
+	for _, name := range names {
+		srv.VHosts[strings.ToLower(name)] = &vh
+	}
+	return &vh
+}
+
+func (srv *Server) tunnelAllowed(ip string) (bool) {
+	if inNets(ip, srv.Deny) {
+		return false
+	}
+	if srv.Allow != nil && !inNets(ip, srv.Allow) {
+		return false
+	}
+	return !srv.ban.banned(ip)
+}
+
+func (srv *Server) fail(ip string, reason string) {
+	if srv.ban.fail(ip, srv.BanMaxFail, srv.BanFindTime, srv.BanTime) {
+		Vlogln(2, "[ban]", ip, "for", srv.BanTime, "last fail:", reason)
+	}
+}
+
+// banned address -> ban until
+func (srv *Server) Bans() (map[string]time.Time) {
+	return srv.ban.bans()
+}
+
+// remove ban, empty ip to clear all
+func (srv *Server) Unban(ip string) (bool) {
+	return srv.ban.unban(ip)
+}
+
+// client IP without port
+func (srv *Server) clientIP(r *http.Request) (string) {
+	if ip := srv.realIP(r); ip != "" {
+		return ip
+	}
+	return hostOnly(r.RemoteAddr)
 }
 
-func (srv *Server) handleBase(w http.ResponseWriter, r *http.Request)  {
+// client IP from headers set by trusted proxy, empty if not found
+func (srv *Server) realIP(r *http.Request) (string) {
+	if !inNets(hostOnly(r.RemoteAddr), srv.TrustedProxies) {
+		return ""
+	}
+
+	// only one header, client can send any other one through proxy
+	name := srv.IPHeader
+	if name == "" {
+		return ""
+	}
+	var list []string
+	for _, value := range r.Header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(name, "Forwarded") {
+				v = forwardedFor(v)
+			}
+			v = strings.Trim(strings.TrimSpace(v), "\"")
+			if ip := net.ParseIP(hostOnly(v)); ip != nil {
+				list = append(list, ip.String())
+			} else if ip := net.ParseIP(strings.Trim(v, "[]")); ip != nil {
+				list = append(list, ip.String())
+			}
+		}
+	}
+
+	// appended by each proxy, the right most untrusted one is client
+	for i := len(list) - 1; i >= 0; i-- {
+		if i == 0 || !inNets(list[i], srv.TrustedProxies) {
+			return list[i]
+		}
+	}
+	return ""
+}
+
+// get "for" from: for=192.0.2.60;proto=http;by=203.0.113.43
+func forwardedFor(value string) (string) {
+	for _, pair := range strings.Split(value, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// verify per request flag and nonce, return TxFlag or RxFlag
+func (srv *Server) checkFlag(vh *VHost, value string, token string, method string) (string, bool) {
+	if srv.LegacyFlag && (value == vh.RxFlag || value == vh.TxFlag) {
+		return value, true
+	}
+
+	for _, flag := range []string{vh.RxFlag, vh.TxFlag} {
+		nonce, ok := checkFlag(value, flag, srv.PSK, token, method)
+		if !ok {
+			continue
+		}
+		if !srv.replay.add(nonce, srv.ReplayCacheSize, srv.TokenTTL) {
+			Vlogln(2, "replay nonce:", token, value)
+			return "", false
+		}
+		return flag, true
+	}
+
+	Vlogln(3, "flag err:", token, value)
+	return "", false
+}
+
+func (srv *Server) handleBase(w http.ResponseWriter, r *http.Request, vh *VHost)  {
 	header := w.Header()
-	header.Set("Server", srv.HeaderServer)
+	header.Set("Server", vh.HeaderServer)
 	token := randStringBytes(16)
 	expiration := time.Now().AddDate(0, 0, 3)
-	cookie := http.Cookie{Name: srv.TokenCookieA, Value: token, Expires: expiration}
+	cookie := http.Cookie{Name: vh.TokenCookieA, Value: token, Expires: expiration}
 	http.SetCookie(w, &cookie)
-	srv.regToken(token)
+	srv.regToken(token, srv.clientIP(r), vh.Name)
 
-	Vlogln(2, "web:", r.URL.Path, token)
+	Vlogln(2, "web:", vh.Name, srv.clientIP(r), r.URL.Path, token)
 
-	srv.HttpHandler.ServeHTTP(w, r)
+	vh.HttpHandler.ServeHTTP(w, r)
 }
 
-func (srv *Server) handleWs(w http.ResponseWriter, r *http.Request, token string, flag string, cc *state)  {
+// return false if not handled, and nothing written to w
+func (srv *Server) handleWs(w http.ResponseWriter, r *http.Request, vh *VHost, token string, flag string, cc *state) (bool) {
 //	for k, v := range r.Header {
 //		Vlogln(4, "[ws]", k, v)
 //	}
-//	ip := r.Header.Get("X-Forwarded-For")
-//	Vlogln(4, "X-Forwarded-For", ip)
-	ip := r.Header.Get("Cf-Connecting-Ip")
+	ip := srv.realIP(r)
+
+	if r.Method != vh.RxMethod || flag != vh.RxFlag {
+		Vlogln(3, "ws flag mismatch:", r.Method, flag)
+		return false
+	}
+
+	pubC, ok := srv.clientKey(r, vh)
+	if !ok {
+		return false
+	}
 
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		Vlogln(2, "hijacking err1:", ok)
-		return
+		return false
 	}
 	Vlogln(3, "hijacking ok1")
 
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	if cc.dead || cc.connR != nil || cc.connW != nil {
+		Vlogln(3, "ws token used:", token)
+		return false
+	}
+	if pubC != "" {
+		var err error
+		if cc.priv, cc.pubS, err = newKeyPair(); err != nil {
+			Vlogln(2, "ws key pair err:", token, err)
+			return false
+		}
+		cc.pubC = pubC
+	}
+	cc.shape = srv.askShape(r, vh)
+
 	conn, bufrw, err := hj.Hijack()
 	if err != nil {
 		Vlogln(2, "hijacking err:", err)
-		return
+		return true
 	}
 	Vlogln(3, "hijacking ok2")
 	bufrw.Flush()
 
-	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + token + "\r\n\r\n"))
+	// not permessage-deflate frames, never answer that extension
+	codec := ""
+	ext := ""
+	if srv.askComp(r, vh) {
+		codec = codecDeflate
+		ext = "Set-Cookie: " + srv.mkCookie(vh.CompCookie, randStringBytes(16)) + "\r\n"
+	}
+	if cc.pubS != "" {
+		ext += "Set-Cookie: " + srv.mkCookie(vh.KeyCookie, cc.pubS) + "\r\n"
+	}
+	if cc.shape {
+		ext += "Set-Cookie: " + srv.mkCookie(vh.ShapeCookie, randStringBytes(16)) + "\r\n"
+	}
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nServer: " + vh.HeaderServer + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + token + "\r\n" + ext + "\r\n"))
 
-	cc.mx.Lock()
-	defer cc.mx.Unlock()
-	if r.Method == srv.RxMethod && flag == srv.RxFlag  {
-		Vlogln(2, token, " <-> client")
-		srv.rmToken(token)
-		srv.accepts <- mkConnAddr(conn, ip)
+	Vlogln(2, token, " <-> client")
+	cc.dead = true
+	srv.rmToken(token)
+	wconn, err := srv.wrapConn(conn, cc, token, codec, codec)
+	if err != nil {
+		Vlogln(2, "ws key exchange err:", token, err)
+		return true
 	}
+	srv.accepts <- mkConnAddr(wconn, ip, vh.Name, r.URL.Path)
+
 	Vlogln(3, "ws init end")
+	return true
 }
 
-func (srv *Server) handleNonWs(w http.ResponseWriter, r *http.Request, token string, flag string, cc *state)  {
-	flusher, ok := w.(http.Flusher)
+// return false if not handled, and nothing written to w
+func (srv *Server) handleNonWs(w http.ResponseWriter, r *http.Request, vh *VHost, token string, flag string, cc *state) (bool) {
+	isRx := r.Method == vh.RxMethod && flag == vh.RxFlag
+	isTx := r.Method == vh.TxMethod && flag == vh.TxFlag
+	if !isRx && !isTx {
+		Vlogln(3, "non-ws flag mismatch:", r.Method, flag)
+		return false
+	}
+
+	pubC, ok := srv.clientKey(r, vh)
 	if !ok {
-		srv.handleBase(w,r)
-		return
+		return false
 	}
-	header := w.Header()
-	header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
-	header.Set("Content-Encoding", "gzip")
-	flusher.Flush()
-	Vlogln(3, "Flush")
 
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return false
+	}
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		Vlogln(2, "hijacking err1:", ok)
-		return
+		return false
 	}
 	Vlogln(3, "hijacking ok1")
 
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	if cc.dead || (isRx && cc.connW != nil) || (isTx && cc.connR != nil) {
+		Vlogln(3, "non-ws token used:", token)
+		return false
+	}
+	if cc.connR != nil || cc.connW != nil {
+		if pubC != cc.pubC { // other leg has different key
+			Vlogln(3, "non-ws key mismatch:", token)
+			return false
+		}
+		if r.URL.Path != cc.path { // route by path, both leg same
+			Vlogln(3, "non-ws path mismatch:", token, cc.path, r.URL.Path)
+			return false
+		}
+	} else {
+		if pubC != "" {
+			var err error
+			if cc.priv, cc.pubS, err = newKeyPair(); err != nil {
+				Vlogln(2, "non-ws key pair err:", token, err)
+				return false
+			}
+			cc.pubC = pubC
+		}
+		cc.shape = srv.askShape(r, vh)
+		cc.path = r.URL.Path
+		time.AfterFunc(srv.PairTimeout, func() {
+			srv.closeUnpaired(token, cc)
+		})
+	}
+
+	if isTx && r.Header.Get("Content-Encoding") == codecGzip && cc.layered() { // body would not be gzip on wire
+		Vlogln(3, "non-ws gzip under encrypt/shape:", token)
+		return false
+	}
+
+	header := w.Header()
+	header.Set("Server", vh.HeaderServer)
+	header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
+	if cc.pubS != "" {
+		header.Add("Set-Cookie", srv.mkCookie(vh.KeyCookie, cc.pubS))
+	}
+	if cc.shape {
+		header.Add("Set-Cookie", srv.mkCookie(vh.ShapeCookie, randStringBytes(16)))
+	}
+	// Accept-Encoding alone sent by any browser; only claim gzip when it is the outermost layer
+	if isRx && srv.askComp(r, vh) && acceptGzip(r.Header) && !cc.layered() {
+		header.Set("Content-Encoding", codecGzip)
+		cc.codecW = codecGzip
+	}
+	flusher.Flush()
+	Vlogln(3, "Flush")
+
 	conn, bufrw, err := hj.Hijack()
 	if err != nil {
 		Vlogln(2, "hijacking err:", err)
-		return
+		return true
 	}
 	Vlogln(3, "hijacking ok2")
 	bufrw.Flush()
+	conn = newChunkConn(conn) // header flushed as chunked
 
-	cc.mx.Lock()
-	defer cc.mx.Unlock()
-	if r.Method == srv.RxMethod && flag == srv.RxFlag {
+	if isRx {
 		Vlogln(2, token, " -> client")
 		cc.connW = conn
 	}
-	if r.Method == srv.TxMethod && flag == srv.TxFlag  {
+	if isTx {
 		Vlogln(2, token, " <- client")
 		cc.connR = conn
+		if r.Header.Get("Content-Encoding") == codecGzip {
+			cc.codecR = codecGzip
+		}
 		cc.bufR = bufrw
 	}
 	if cc.connR != nil && cc.connW != nil {
+		cc.dead = true
 		srv.rmToken(token)
 
 		n := cc.bufR.Reader.Buffered()
 		buf := make([]byte, n)
 		cc.bufR.Reader.Read(buf[:n])
-		srv.accepts <- mkconn(cc.connR, cc.connW, buf[:n])
+		conn, err := srv.wrapConn(mkconn(cc.connR, cc.connW, buf[:n]), cc, token, cc.codecR, cc.codecW)
+		if err != nil {
+			Vlogln(2, "non-ws key exchange err:", token, err)
+			return true
+		}
+		srv.accepts <- mkConnAddr(conn, srv.realIP(r), vh.Name, r.URL.Path)
 	}
 	Vlogln(3, "non-ws init end")
+	return true
 }
 
-func (srv *Server) regToken(token string) {
+// client's public key, must have one if Encrypt
+func (srv *Server) clientKey(r *http.Request, vh *VHost) (string, bool) {
+	ck, err := r.Cookie(vh.KeyCookie)
+	if err != nil || ck.Value == "" {
+		if srv.Encrypt {
+			Vlogln(3, "no client key:", r.RemoteAddr)
+			return "", false
+		}
+		return "", true
+	}
+	return ck.Value, true
+}
+
+// encrypt or shape wrap outside compress, gzip not what on wire
+func (cc *state) layered() (bool) {
+	return cc.priv != nil || cc.shape
+}
+
+func (srv *Server) askComp(r *http.Request, vh *VHost) (bool) {
+	if !srv.Compress {
+		return false
+	}
+	_, err := r.Cookie(vh.CompCookie)
+	return err == nil
+}
+
+func (srv *Server) askShape(r *http.Request, vh *VHost) (bool) {
+	if !srv.Shape {
+		return false
+	}
+	_, err := r.Cookie(vh.ShapeCookie)
+	return err == nil
+}
+
+func (srv *Server) mkCookie(name string, value string) (string) {
+	return (&http.Cookie{Name: name, Value: value, Path: "/", HttpOnly: true}).String()
+}
+
+// encrypt outside, shape, then compress, jitter on app write
+func (srv *Server) wrapConn(conn net.Conn, cc *state, token string, rCodec string, wCodec string) (net.Conn, error) {
+	if cc.priv != nil {
+		rKey, wKey, err := deriveKeys(cc.priv, cc.pubC, srv.PSK, token, false)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		econn, err := newCryptConn(conn, rKey, wKey)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = econn
+	}
+	if cc.shape {
+		conn = newShapeConn(conn, srv.ShapeBudget)
+	}
+	conn = newCompConn(conn, rCodec, wCodec)
+	if cc.shape {
+		conn = newJitterConn(conn, srv.ShapeJitter)
+	}
+	return conn, nil
+}
+
+func (srv *Server) regToken(token string, ip string, host string) {
 	srv.mx.Lock()
 	defer srv.mx.Unlock()
 
@@ -304,6 +706,8 @@ func (srv *Server) regToken(token string) {
 		Vlogln(2, "dobule token err:", token)
 	}
 	srv.states[token] = &state {
+		IP: ip,
+		host: host,
 		ttl: time.Now().Add(srv.TokenTTL),
 	}
 }
@@ -321,6 +725,31 @@ func (srv *Server) checkToken(token string) (*state, bool) {
 	}
 	return c, true
 }
+// register token made by client with PSK, only once
+func (srv *Server) checkPSKToken(token string, ip string, host string) (*state, bool) {
+	if !checkPSKToken(srv.PSK, token, srv.TokenTTL) {
+		return nil, false
+	}
+
+	srv.mx.Lock()
+	defer srv.mx.Unlock()
+
+	// other leg may register it
+	if c, ok := srv.states[token]; ok {
+		return c, true
+	}
+	if !srv.replay.add("token:" + token, srv.ReplayCacheSize, 2 * srv.TokenTTL) {
+		return nil, false
+	}
+	c := &state {
+		IP: ip,
+		host: host,
+		ttl: time.Now().Add(srv.TokenTTL),
+	}
+	srv.states[token] = c
+	return c, true
+}
+
 func (srv *Server) rmToken(token string) {
 	srv.mx.Lock()
 	defer srv.mx.Unlock()
@@ -357,21 +786,51 @@ func (srv *Server) tokenCleaner() {
 		}
 		srv.mx.Unlock()
 
+		srv.replay.Clean()
+		srv.ban.clean(srv.BanFindTime)
+
 		// check and close half open connection
 		for _, cc := range list {
 			cc.mx.Lock()
-			if cc.connR == nil && cc.connW != nil {
-				cc.connW.Close()
-				cc.connW = nil
-				Vlogln(4, "[gc]half open W", cc)
-			}
-			if cc.connR != nil && cc.connW == nil {
-				cc.connR.Close()
-				cc.connR = nil
-				Vlogln(4, "[gc]half open R", cc)
-			}
+			cc.dead = true
+			cc.closeHalf()
 			cc.mx.Unlock()
 		}
 	}
 }
 
+// other leg not come in PairTimeout
+func (srv *Server) closeUnpaired(token string, cc *state) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	if cc.dead {
+		return
+	}
+	cc.dead = true
+	srv.rmToken(token)
+	cc.closeHalf()
+	Vlogln(3, "unpaired leg closed:", token)
+}
+
+// end half open leg like a finished response, lock cc.mx before call
+func (cc *state) closeHalf() {
+	if cc.connR != nil && cc.connW != nil {
+		return
+	}
+	if cc.connW != nil {
+		cc.connW.SetWriteDeadline(time.Now().Add(timeout))
+		if cc.codecW == codecGzip { // valid empty body for Content-Encoding
+			zw := gzip.NewWriter(cc.connW)
+			zw.Close()
+		}
+		cc.connW.Close() // chunkConn end the body
+		cc.connW = nil
+		Vlogln(4, "[gc]half open W", cc)
+	}
+	if cc.connR != nil {
+		cc.connR.Close()
+		cc.connR = nil
+		Vlogln(4, "[gc]half open R", cc)
+	}
+}
+
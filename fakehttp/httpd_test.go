@@ -0,0 +1,176 @@
+package fakehttp
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		in    string
+		out   string
+	}{
+		{"for=192.0.2.60;proto=http;by=203.0.113.43", "192.0.2.60"},
+		{"proto=https; For=\"[2001:db8::1]:4711\"", "\"[2001:db8::1]:4711\""},
+		{"by=203.0.113.43", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if out := forwardedFor(tt.in); out != tt.out {
+			t.Errorf("%q: got %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  string
+		hdr     string
+		header  map[string][]string
+		ip      string
+	}{
+		{"untrusted peer", "192.0.2.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, ""},
+		{"no header name", "10.0.0.1:1234", "",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, ""},
+		{"xff", "10.0.0.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"xff forged by client", "10.0.0.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1"}}, "198.51.100.1"},
+		{"xff chain of trusted proxy", "10.0.0.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"xff multiple lines", "10.0.0.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1"}}, "198.51.100.1"},
+		{"xff all trusted", "10.0.0.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"xff with port", "10.0.0.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1:5555"}}, "198.51.100.1"},
+		{"xff bad value", "10.0.0.1:1234", "X-Forwarded-For",
+			map[string][]string{"X-Forwarded-For": {"unknown"}}, ""},
+		{"real ip only", "10.0.0.1:1234", "X-Real-IP",
+			map[string][]string{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		// proxy overwrite X-Real-IP, pass XFF from client
+		{"other header ignored", "10.0.0.1:1234", "X-Real-IP",
+			map[string][]string{"X-Real-Ip": {"198.51.100.1"}, "X-Forwarded-For": {"1.1.1.1"}}, "198.51.100.1"},
+		{"header missing", "10.0.0.1:1234", "X-Real-IP",
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, ""},
+		{"cf", "10.0.0.1:1234", "Cf-Connecting-Ip",
+			map[string][]string{"Cf-Connecting-Ip": {"2001:db8::1"}}, "2001:db8::1"},
+		{"forwarded", "10.0.0.1:1234", "Forwarded",
+			map[string][]string{"Forwarded": {"for=1.1.1.1, for=198.51.100.1;proto=https"}}, "198.51.100.1"},
+		{"forwarded ipv6", "10.0.0.1:1234", "Forwarded",
+			map[string][]string{"Forwarded": {"for=\"[2001:db8::1]:4711\""}}, "2001:db8::1"},
+		{"forwarded no for", "10.0.0.1:1234", "Forwarded",
+			map[string][]string{"Forwarded": {"proto=https"}}, ""},
+	}
+
+	srv := NewServer(nil)
+	srv.TrustedProxies, _ = ParseCIDRs("10.0.0.0/8")
+	for _, tt := range tests {
+		srv.IPHeader = tt.hdr
+		r := &http.Request{RemoteAddr: tt.remote, Header: http.Header(tt.header)}
+		if ip := srv.realIP(r); ip != tt.ip {
+			t.Errorf("%s: got %q, want %q", tt.name, ip, tt.ip)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	srv := NewServer(nil)
+	r := &http.Request{RemoteAddr: "192.0.2.1:1234", Header: http.Header{"X-Forwarded-For": {"1.1.1.1"}}}
+	if ip := srv.clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("got %q, want peer address", ip)
+	}
+}
+
+// Accept-Encoding sent by every profile, compress only when client ask by cookie
+func TestAskComp(t *testing.T) {
+	srv := NewServer(nil)
+	vh := &srv.VHost
+	tests := []struct {
+		compress bool
+		cookie   string
+		want     bool
+	}{
+		{true, "", false},
+		{true, vh.CompCookie + "=x", true},
+		{false, vh.CompCookie + "=x", false},
+		{true, "other=x", false},
+	}
+	for _, tt := range tests {
+		srv.Compress = tt.compress
+		r := &http.Request{Header: http.Header{"Accept-Encoding": {"gzip, deflate, br"}}}
+		if tt.cookie != "" {
+			r.Header.Set("Cookie", tt.cookie)
+		}
+		if got := srv.askComp(r, vh) && acceptGzip(r.Header); got != tt.want {
+			t.Errorf("compress %v cookie %q: got %v, want %v", tt.compress, tt.cookie, got, tt.want)
+		}
+	}
+}
+
+func TestVHostMatch(t *testing.T) {
+	srv := NewServer(nil)
+	if vh := srv.vhost(&http.Request{Host: "a.test"}); vh != &srv.VHost {
+		t.Fatal("no vhost should use default")
+	}
+	a := srv.NewVHost("A.test", "alias.test")
+	b := srv.NewVHost("b.test")
+	a.TokenCookieA = "xa"
+	if srv.VHost.TokenCookieA == "xa" {
+		t.Fatal("vhost not copy of default")
+	}
+
+	tests := []struct {
+		host  string
+		sni   string
+		want  *VHost
+	}{
+		{"a.test", "", a},
+		{"A.TEST:8443", "", a},
+		{"alias.test", "", a},
+		{"[::1]:443", "b.test", b},
+		{"b.test", "a.test", b}, // Host first
+		{"other.test", "B.test", b},
+		{"other.test", "", &srv.VHost},
+		{"", "", &srv.VHost},
+	}
+	for _, tt := range tests {
+		r := &http.Request{Host: tt.host}
+		if tt.sni != "" {
+			r.TLS = &tls.ConnectionState{ServerName: tt.sni}
+		}
+		if got := srv.vhost(r); got != tt.want {
+			t.Errorf("host %q sni %q: got %q, want %q", tt.host, tt.sni, got.Name, tt.want.Name)
+		}
+	}
+}
+
+// leg from other network served as normal web request
+func TestServerBindIP(t *testing.T) {
+	srv := NewHandle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "decoy")
+	}))
+	srv.BindIP = true
+	srv.BindPrefix4 = 24
+	vh := &srv.VHost
+	srv.regToken("token", "192.0.2.1", vh.Name)
+
+	for _, remote := range []string{"192.0.3.1:1234", "[2001:db8::1]:1234", "[::ffff:198.51.100.1]:1234"} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("Cookie", vh.TokenCookieB + "=token; " + vh.TokenCookieC + "=" + mkFlag(vh.TxFlag, nil, "token", "POST"))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Body.String() != "decoy" {
+			t.Errorf("%s: tunnel accepted from other network", remote)
+		}
+	}
+	if _, ok := srv.checkToken("token"); !ok {
+		t.Fatal("token dropped by mismatch leg")
+	}
+}
@@ -0,0 +1,179 @@
+package fakehttp
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoServer        = errors.New("no server")
+)
+
+// failover between multiple servers, each with its own Client settings
+type MultiClient struct {
+	mx            sync.Mutex
+	list          []*serverState
+	next          int
+	probeOnce     sync.Once
+
+	Spread        bool // spread new tunnel across healthy servers, not priority order
+	Backoff       time.Duration // retry delay after first fail, double each fail, 0 for no backoff
+	MaxBackoff    time.Duration // <= 0 for no limit
+	ProbeInterval time.Duration // re-probe failed server in background, 0 to disable
+}
+
+type serverState struct {
+	srv      multiServer
+	name     string
+	fails    int
+	retryAt  time.Time
+}
+
+// *Client, or fake one in test
+type multiServer interface {
+	Dialer
+	probe() (error)
+}
+
+// get token only, no tunnel
+func (cl *Client) probe() (error) {
+	_, err := cl.getToken()
+	return err
+}
+
+// list in priority order
+func NewMultiClient(list ...*Client) (*MultiClient) {
+	mc := &MultiClient{
+		Backoff: backoffMin,
+		MaxBackoff: backoffMax,
+		ProbeInterval: probeInterval,
+	}
+	for _, cl := range list {
+		mc.list = append(mc.list, &serverState{srv: cl, name: cl.Host})
+	}
+	return mc
+}
+
+func (mc *MultiClient) Dial() (net.Conn, error) {
+	mc.probeOnce.Do(func() {
+		go mc.probe()
+	})
+
+	err := ErrNoServer
+	for _, ss := range mc.order() {
+		var conn net.Conn
+		conn, err = ss.srv.Dial()
+		if err != nil {
+			Vlogln(2, "server:", ss.name, "err:", err)
+			mc.fail(ss)
+			continue
+		}
+		mc.ok(ss)
+		Vlogln(3, "server:", ss.name)
+		return conn, nil
+	}
+	return nil, err
+}
+
+// healthy ones (priority or spread), failed ones by retry time only if none healthy
+func (mc *MultiClient) order() ([]*serverState) {
+	mc.mx.Lock()
+	defer mc.mx.Unlock()
+
+	now := time.Now()
+	var healthy, failed []*serverState
+	for _, ss := range mc.list {
+		if now.Before(ss.retryAt) {
+			failed = append(failed, ss)
+		} else {
+			healthy = append(healthy, ss)
+		}
+	}
+
+	if mc.Spread && len(healthy) > 1 {
+		n := mc.next % len(healthy)
+		mc.next++
+		healthy = append(healthy[n:], healthy[:n]...)
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	sort.SliceStable(failed, func(i, j int) bool {
+		return failed[i].retryAt.Before(failed[j].retryAt)
+	})
+	return failed
+}
+
+func (mc *MultiClient) fail(ss *serverState) {
+	mc.mx.Lock()
+	defer mc.mx.Unlock()
+
+	backoff := mc.backoff(ss.fails)
+	ss.fails++
+	ss.retryAt = time.Now().Add(backoff)
+	Vlogln(2, "server:", ss.name, "fail", ss.fails, "times, retry after", backoff)
+}
+
+// Backoff doubled for each previous fail, up to MaxBackoff
+func (mc *MultiClient) backoff(fails int) (time.Duration) {
+	if mc.Backoff <= 0 {
+		return 0
+	}
+	backoff := mc.Backoff
+	for i := 0; i < fails; i++ {
+		if mc.MaxBackoff > 0 && backoff >= mc.MaxBackoff {
+			break
+		}
+		if backoff > math.MaxInt64 / 2 { // no overflow without limit
+			break
+		}
+		backoff *= 2
+	}
+	if mc.MaxBackoff > 0 && backoff > mc.MaxBackoff {
+		backoff = mc.MaxBackoff
+	}
+	return backoff
+}
+
+func (mc *MultiClient) ok(ss *serverState) {
+	mc.mx.Lock()
+	defer mc.mx.Unlock()
+
+	if ss.fails > 0 {
+		Vlogln(2, "server:", ss.name, "recovered")
+	}
+	ss.fails = 0
+	ss.retryAt = time.Time{}
+}
+
+// get token from failed server when backoff end
+func (mc *MultiClient) probe() {
+	if mc.ProbeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(mc.ProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		var list []*serverState
+		mc.mx.Lock()
+		for _, ss := range mc.list {
+			if ss.fails > 0 && now.After(ss.retryAt) {
+				list = append(list, ss)
+			}
+		}
+		mc.mx.Unlock()
+
+		for _, ss := range list {
+			if err := ss.srv.probe(); err != nil {
+				mc.fail(ss)
+			} else {
+				mc.ok(ss)
+			}
+		}
+	}
+}
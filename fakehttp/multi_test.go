@@ -0,0 +1,213 @@
+package fakehttp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFakeDial = errors.New("fake dial fail")
+
+// Dialer for test, count dial & probe
+type fakeServer struct {
+	mx      sync.Mutex
+	name    string
+	down    bool
+	dials   int
+	probes  int
+}
+
+func (fs *fakeServer) Dial() (net.Conn, error) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	fs.dials++
+	if fs.down {
+		return nil, errFakeDial
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (fs *fakeServer) probe() (error) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	fs.probes++
+	if fs.down {
+		return errFakeDial
+	}
+	return nil
+}
+
+func (fs *fakeServer) set(down bool) {
+	fs.mx.Lock()
+	fs.down = down
+	fs.mx.Unlock()
+}
+
+func (fs *fakeServer) count() (int, int) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	return fs.dials, fs.probes
+}
+
+func newFakeMulti(n int) (*MultiClient, []*fakeServer) {
+	mc := NewMultiClient()
+	mc.ProbeInterval = 0
+	var list []*fakeServer
+	for i := 0; i < n; i++ {
+		fs := &fakeServer{name: string(rune('a' + i))}
+		list = append(list, fs)
+		mc.list = append(mc.list, &serverState{srv: fs, name: fs.name})
+	}
+	return mc, list
+}
+
+func orderNames(mc *MultiClient) (string) {
+	s := ""
+	for _, ss := range mc.order() {
+		s += ss.name
+	}
+	return s
+}
+
+func TestMultiOrder(t *testing.T) {
+	mc, _ := newFakeMulti(3)
+	if got := orderNames(mc); got != "abc" {
+		t.Fatalf("priority order %q", got)
+	}
+
+	mc.Spread = true
+	for _, want := range []string{"abc", "bca", "cab", "abc"} {
+		if got := orderNames(mc); got != want {
+			t.Fatalf("spread order %q, want %q", got, want)
+		}
+	}
+	mc.Spread = false
+
+	// in backoff skipped while any healthy
+	mc.fail(mc.list[0])
+	if got := orderNames(mc); got != "bc" {
+		t.Fatalf("with a in backoff %q", got)
+	}
+
+	// all in backoff, earliest retry first
+	mc.list[2].retryAt = time.Now().Add(time.Minute)
+	mc.list[1].retryAt = time.Now().Add(time.Hour)
+	if got := orderNames(mc); got != "acb" {
+		t.Fatalf("all in backoff %q", got)
+	}
+}
+
+func TestMultiDial(t *testing.T) {
+	mc, list := newFakeMulti(2)
+	list[0].set(true)
+
+	for i := 0; i < 3; i++ {
+		conn, err := mc.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if d, _ := list[0].count(); d != 1 {
+		t.Fatalf("failed server dialed %d times inside backoff", d)
+	}
+	if d, _ := list[1].count(); d != 3 {
+		t.Fatalf("healthy server dialed %d times", d)
+	}
+
+	list[1].set(true)
+	if _, err := mc.Dial(); err != errFakeDial {
+		t.Fatalf("all down: %v", err)
+	}
+	// no healthy one left, retry those in backoff
+	if _, err := mc.Dial(); err != errFakeDial {
+		t.Fatalf("all down: %v", err)
+	}
+	if d, _ := list[0].count(); d != 2 {
+		t.Fatalf("server in backoff not retried when none left, dialed %d", d)
+	}
+
+	list[0].set(false)
+	mc.list[0].retryAt = time.Time{}
+	if conn, err := mc.Dial(); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+	if mc.list[0].fails != 0 {
+		t.Fatal("fail count not reset after success")
+	}
+}
+
+func TestMultiBackoff(t *testing.T) {
+	mc, _ := newFakeMulti(1)
+	mc.Backoff = time.Second
+	mc.MaxBackoff = 5 * time.Second
+	want := []time.Duration{1, 2, 4, 5, 5}
+	for i, w := range want {
+		if got := mc.backoff(i); got != w * time.Second {
+			t.Errorf("fails %d: backoff %v, want %v", i, got, w * time.Second)
+		}
+	}
+
+	ss := mc.list[0]
+	mc.fail(ss)
+	mc.fail(ss)
+	if d := time.Until(ss.retryAt); d < time.Second || d > 2 * time.Second {
+		t.Fatalf("retry after %v, want 2s", d)
+	}
+
+	mc.MaxBackoff = 0 // no limit, no overflow
+	if got := mc.backoff(100); got <= 0 {
+		t.Fatalf("no limit backoff %v", got)
+	}
+
+	mc.Backoff = 0
+	for i := 0; i < 5; i++ {
+		mc.fail(ss)
+	}
+	if ss.retryAt.After(time.Now()) {
+		t.Fatal("retry delayed with no backoff")
+	}
+	if got := orderNames(mc); got != "a" {
+		t.Fatalf("no backoff, order %q", got)
+	}
+}
+
+func TestMultiProbe(t *testing.T) {
+	mc, list := newFakeMulti(2)
+	mc.Backoff = time.Millisecond
+	mc.ProbeInterval = 5 * time.Millisecond
+	list[0].set(true)
+	if conn, err := mc.Dial(); err != nil { // start probe, a failed
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, p := list[0].count(); p == 0 {
+		t.Fatal("failed server not probed")
+	}
+	if _, p := list[1].count(); p != 0 {
+		t.Fatal("healthy server probed")
+	}
+
+	list[0].set(false)
+	for i := 0; i < 100; i++ {
+		mc.mx.Lock()
+		fails := mc.list[0].fails
+		mc.mx.Unlock()
+		if fails == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := orderNames(mc); got != "ab" {
+		t.Fatalf("not recovered by probe, order %q", got)
+	}
+}
@@ -0,0 +1,152 @@
+package fakehttp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type Dialer interface {
+	Dial() (net.Conn, error)
+}
+
+// keep some handshaken tunnels ready, replenish in background
+type Pool struct {
+	mx        sync.Mutex
+	idle      []pooledConn
+	wake      chan struct{}
+	startOnce sync.Once
+
+	Dialer    Dialer
+	Size      int
+	MaxIdle   time.Duration // close idle tunnel before server side (target) timeout, 0 to keep forever
+	Backoff   time.Duration // retry delay after dial error, double each fail, <= 0 for default
+}
+
+type pooledConn struct {
+	conn     net.Conn
+	ttl      time.Time // zero for never expire
+}
+
+func (pc pooledConn) alive(now time.Time) (bool) {
+	return pc.ttl.IsZero() || now.Before(pc.ttl)
+}
+
+func NewPool(dl Dialer, size int) (*Pool) {
+	return &Pool{
+		wake: make(chan struct{}, 1),
+		Dialer: dl,
+		Size: size,
+		MaxIdle: poolMaxIdle,
+		Backoff: backoffMin,
+	}
+}
+
+// start fill pool, also called by first Dial()
+func (p *Pool) Start() {
+	p.startOnce.Do(func() {
+		go p.fill()
+	})
+}
+
+// get a ready tunnel, or dial a new one if pool empty
+func (p *Pool) Dial() (net.Conn, error) {
+	p.Start()
+
+	now := time.Now()
+	p.mx.Lock()
+	for len(p.idle) > 0 {
+		pc := p.idle[0]
+		p.idle = p.idle[1:]
+		if pc.alive(now) {
+			p.mx.Unlock()
+			p.notify()
+			Vlogln(3, "[pool] get:", pc.conn.RemoteAddr())
+			return pc.conn, nil
+		}
+		pc.conn.Close()
+	}
+	p.mx.Unlock()
+
+	p.notify()
+	return p.Dialer.Dial()
+}
+
+func (p *Pool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drop expired, return count of idle
+func (p *Pool) clean() (int) {
+	now := time.Now()
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	list := p.idle[:0]
+	for _, pc := range p.idle {
+		if pc.alive(now) {
+			list = append(list, pc)
+		} else {
+			Vlogln(3, "[pool] recycle:", pc.conn.RemoteAddr())
+			pc.conn.Close()
+		}
+	}
+	p.idle = list
+	return len(list)
+}
+
+// check interval, half of MaxIdle but not too short
+func (p *Pool) checkInterval() (time.Duration) {
+	check := poolCheck
+	if p.MaxIdle > 0 && p.MaxIdle / 2 < check {
+		check = p.MaxIdle / 2
+	}
+	if check < poolCheckMin {
+		check = poolCheckMin
+	}
+	return check
+}
+
+func (p *Pool) fill() {
+	ticker := time.NewTicker(p.checkInterval())
+	defer ticker.Stop()
+
+	base := p.Backoff
+	if base <= 0 {
+		base = backoffMin
+	}
+	backoff := base
+	for {
+		// count once each round, tunnel may expire before next one ready
+		for n := p.Size - p.clean(); n > 0; n-- {
+			conn, err := p.Dialer.Dial()
+			if err != nil {
+				Vlogln(2, "[pool] dial err:", err, "retry after", backoff)
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > poolBackoffMax {
+					backoff = poolBackoffMax
+				}
+				n++
+				continue
+			}
+			backoff = base
+
+			var ttl time.Time
+			if p.MaxIdle > 0 {
+				ttl = time.Now().Add(p.MaxIdle)
+			}
+			p.mx.Lock()
+			p.idle = append(p.idle, pooledConn{conn, ttl})
+			p.mx.Unlock()
+		}
+
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
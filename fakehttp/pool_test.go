@@ -0,0 +1,113 @@
+package fakehttp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// wait until cond or timeout
+func waitFor(t *testing.T, what string, cond func() (bool)) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timeout:", what)
+}
+
+func (p *Pool) idleCount() (int) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return len(p.idle)
+}
+
+func TestPoolRefill(t *testing.T) {
+	fs := &fakeServer{}
+	p := NewPool(fs, 2)
+	p.Start()
+	waitFor(t, "pool filled", func() (bool) { return p.idleCount() == 2 })
+
+	conn, err := p.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitFor(t, "pool refilled", func() (bool) { return p.idleCount() == 2 })
+	if d, _ := fs.count(); d != 3 {
+		t.Fatalf("dial count %d, want 3", d)
+	}
+}
+
+func TestPoolEmptyDial(t *testing.T) {
+	fs := &fakeServer{}
+	p := NewPool(fs, 0) // nothing kept, dial on demand
+	for i := 0; i < 3; i++ {
+		conn, err := p.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if d, _ := fs.count(); d != 3 {
+		t.Fatalf("dial count %d, want 3", d)
+	}
+}
+
+func TestPoolRecycle(t *testing.T) {
+	fs := &fakeServer{}
+	p := NewPool(fs, 2)
+	p.MaxIdle = 50 * time.Millisecond
+	p.Start()
+	waitFor(t, "pool filled", func() (bool) { return p.idleCount() == 2 })
+
+	// expired ones closed & replaced on next check
+	waitFor(t, "pool recycled", func() (bool) { d, _ := fs.count(); return d >= 4 })
+
+	p.mx.Lock()
+	expired := make(map[net.Conn]bool)
+	for i := range p.idle {
+		p.idle[i].ttl = time.Now().Add(-time.Second)
+		expired[p.idle[i].conn] = true
+	}
+	p.mx.Unlock()
+	conn, err := p.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if expired[conn] {
+		t.Fatal("expired tunnel returned")
+	}
+}
+
+// tunnel expire before next one ready, must not dial without stop
+func TestPoolShortIdle(t *testing.T) {
+	if check := (&Pool{MaxIdle: time.Nanosecond}).checkInterval(); check != poolCheckMin {
+		t.Fatalf("check interval %v", check)
+	}
+	fs := &fakeServer{}
+	p := NewPool(fs, 2)
+	p.MaxIdle = time.Nanosecond
+	p.Start()
+	time.Sleep(poolCheckMin * 3 + poolCheckMin / 2)
+	if d, _ := fs.count(); d > 2 * 5 {
+		t.Fatalf("dial %d times in %v", d, poolCheckMin * 3)
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	fs := &fakeServer{down: true}
+	p := NewPool(fs, 1)
+	p.Backoff = 10 * time.Millisecond
+	p.Start()
+	time.Sleep(100 * time.Millisecond)
+	// 10 + 20 + 40 ms, about 4 dial
+	if d, _ := fs.count(); d < 2 || d > 5 {
+		t.Fatalf("dial %d times in 100ms with backoff", d)
+	}
+
+	fs.set(false)
+	waitFor(t, "pool filled after server up", func() (bool) { return p.idleCount() == 1 })
+}
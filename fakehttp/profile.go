@@ -0,0 +1,348 @@
+package fakehttp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// header set, order & casing of a browser
+// "Name: value" is sent as is, "Name" take value from request, headers not listed are not sent
+type Profile struct {
+	Name      string
+	UserAgent string
+	Page      []string // page load, for token; Accept-Encoding only gzip & deflate, body decoded by fetchAssets
+	Fetch     []string // GET by script, for Rx
+	Post      []string // POST by script, for Tx
+	Asset     []string // css/js/img of page, Accept & Sec-Fetch-Dest from request; Accept-Encoding as Page
+	Ws        []string // websocket
+}
+
+var chromeUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+var chromeCH = []string{
+	`sec-ch-ua: "Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`,
+	"sec-ch-ua-mobile: ?0",
+	`sec-ch-ua-platform: "Windows"`,
+}
+
+var ProfileChrome = &Profile{
+	Name: "chrome131",
+	UserAgent: chromeUA,
+	Page: concat([]string{
+		"Host",
+		"Connection: keep-alive",
+	}, chromeCH, []string{
+		"Upgrade-Insecure-Requests: 1",
+		"User-Agent",
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
+		"Sec-Fetch-Site: none",
+		"Sec-Fetch-Mode: navigate",
+		"Sec-Fetch-User: ?1",
+		"Sec-Fetch-Dest: document",
+		"Accept-Encoding: gzip, deflate",
+		"Accept-Language: en-US,en;q=0.9",
+		"Cookie",
+	}),
+	Fetch: concat([]string{
+		"Host",
+		"Connection: keep-alive",
+		"Pragma: no-cache",
+		"Cache-Control: no-cache",
+	}, chromeCH[2:], []string{
+		"User-Agent",
+	}, chromeCH[:1], []string{
+		"sec-ch-ua-mobile: ?0",
+		"Accept: */*",
+		"Sec-Fetch-Site: same-origin",
+		"Sec-Fetch-Mode: cors",
+		"Sec-Fetch-Dest: empty",
+		"Referer",
+		"Accept-Encoding: gzip, deflate, br, zstd",
+		"Accept-Language: en-US,en;q=0.9",
+		"Cookie",
+	}),
+	Post: concat([]string{
+		"Host",
+		"Connection: keep-alive",
+		"Content-Length",
+		"Pragma: no-cache",
+		"Cache-Control: no-cache",
+	}, chromeCH[2:], []string{
+		"User-Agent",
+	}, chromeCH[:1], []string{
+		"Content-Type",
+		"Content-Encoding",
+		"sec-ch-ua-mobile: ?0",
+		"Accept: */*",
+		"Origin",
+		"Sec-Fetch-Site: same-origin",
+		"Sec-Fetch-Mode: cors",
+		"Sec-Fetch-Dest: empty",
+		"Referer",
+		"Accept-Encoding: gzip, deflate, br, zstd",
+		"Accept-Language: en-US,en;q=0.9",
+		"Cookie",
+	}),
+	Asset: concat([]string{
+		"Host",
+		"Connection: keep-alive",
+	}, chromeCH[2:], []string{
+		"User-Agent",
+	}, chromeCH[:1], []string{
+		"sec-ch-ua-mobile: ?0",
+		"Accept",
+		"Sec-Fetch-Site: same-origin",
+		"Sec-Fetch-Mode: no-cors",
+		"Sec-Fetch-Dest",
+		"Referer",
+		"Accept-Encoding: gzip, deflate",
+		"Accept-Language: en-US,en;q=0.9",
+		"Cookie",
+	}),
+	Ws: []string{
+		"Host",
+		"Connection: Upgrade",
+		"Pragma: no-cache",
+		"Cache-Control: no-cache",
+		"User-Agent",
+		"Upgrade: websocket",
+		"Origin",
+		"Sec-WebSocket-Version: 13",
+		"Accept-Encoding: gzip, deflate, br, zstd",
+		"Accept-Language: en-US,en;q=0.9",
+		"Cookie",
+		"Sec-WebSocket-Key",
+		"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits",
+	},
+}
+
+var ProfileFirefox = &Profile{
+	Name: "firefox133",
+	UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:133.0) Gecko/20100101 Firefox/133.0",
+	Page: []string{
+		"Host",
+		"User-Agent",
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Language: en-US,en;q=0.5",
+		"Accept-Encoding: gzip, deflate",
+		"Connection: keep-alive",
+		"Cookie",
+		"Upgrade-Insecure-Requests: 1",
+		"Sec-Fetch-Dest: document",
+		"Sec-Fetch-Mode: navigate",
+		"Sec-Fetch-Site: none",
+		"Sec-Fetch-User: ?1",
+		"Priority: u=0, i",
+	},
+	Fetch: []string{
+		"Host",
+		"User-Agent",
+		"Accept: */*",
+		"Accept-Language: en-US,en;q=0.5",
+		"Accept-Encoding: gzip, deflate, br, zstd",
+		"Referer",
+		"Connection: keep-alive",
+		"Cookie",
+		"Sec-Fetch-Dest: empty",
+		"Sec-Fetch-Mode: cors",
+		"Sec-Fetch-Site: same-origin",
+		"Pragma: no-cache",
+		"Cache-Control: no-cache",
+		"Priority: u=4",
+	},
+	Post: []string{
+		"Host",
+		"User-Agent",
+		"Accept: */*",
+		"Accept-Language: en-US,en;q=0.5",
+		"Accept-Encoding: gzip, deflate, br, zstd",
+		"Referer",
+		"Content-Type",
+		"Content-Encoding",
+		"Content-Length",
+		"Origin",
+		"Connection: keep-alive",
+		"Cookie",
+		"Sec-Fetch-Dest: empty",
+		"Sec-Fetch-Mode: cors",
+		"Sec-Fetch-Site: same-origin",
+		"Pragma: no-cache",
+		"Cache-Control: no-cache",
+		"Priority: u=4",
+	},
+	Asset: []string{
+		"Host",
+		"User-Agent",
+		"Accept",
+		"Accept-Language: en-US,en;q=0.5",
+		"Accept-Encoding: gzip, deflate",
+		"Connection: keep-alive",
+		"Referer",
+		"Cookie",
+		"Sec-Fetch-Dest",
+		"Sec-Fetch-Mode: no-cors",
+		"Sec-Fetch-Site: same-origin",
+	},
+	Ws: []string{
+		"Host",
+		"User-Agent",
+		"Accept: */*",
+		"Accept-Language: en-US,en;q=0.5",
+		"Accept-Encoding: gzip, deflate, br, zstd",
+		"Sec-WebSocket-Version: 13",
+		"Origin",
+		"Sec-WebSocket-Extensions: permessage-deflate",
+		"Sec-WebSocket-Key",
+		"Connection: keep-alive, Upgrade",
+		"Cookie",
+		"Sec-Fetch-Dest: empty",
+		"Sec-Fetch-Mode: websocket",
+		"Sec-Fetch-Site: same-origin",
+		"Pragma: no-cache",
+		"Cache-Control: no-cache",
+		"Upgrade: websocket",
+	},
+}
+
+var ProfileSafari = &Profile{
+	Name: "safari18",
+	UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.1 Safari/605.1.15",
+	Page: []string{
+		"Host",
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Sec-Fetch-Site: none",
+		"Cookie",
+		"Sec-Fetch-Dest: document",
+		"Accept-Language: en-US,en;q=0.9",
+		"Sec-Fetch-Mode: navigate",
+		"User-Agent",
+		"Upgrade-Insecure-Requests: 1",
+		"Accept-Encoding: gzip, deflate",
+		"Connection: keep-alive",
+	},
+	Fetch: []string{
+		"Host",
+		"Accept: */*",
+		"Sec-Fetch-Site: same-origin",
+		"Cookie",
+		"Sec-Fetch-Dest: empty",
+		"Accept-Language: en-US,en;q=0.9",
+		"Sec-Fetch-Mode: cors",
+		"User-Agent",
+		"Referer",
+		"Accept-Encoding: gzip, deflate, br",
+		"Connection: keep-alive",
+	},
+	Post: []string{
+		"Host",
+		"Accept: */*",
+		"Content-Type",
+		"Content-Encoding",
+		"Sec-Fetch-Site: same-origin",
+		"Origin",
+		"Cookie",
+		"Sec-Fetch-Dest: empty",
+		"Accept-Language: en-US,en;q=0.9",
+		"Sec-Fetch-Mode: cors",
+		"User-Agent",
+		"Referer",
+		"Content-Length",
+		"Accept-Encoding: gzip, deflate, br",
+		"Connection: keep-alive",
+	},
+	Asset: []string{
+		"Host",
+		"Accept",
+		"Sec-Fetch-Site: same-origin",
+		"Cookie",
+		"Sec-Fetch-Dest",
+		"Accept-Language: en-US,en;q=0.9",
+		"Sec-Fetch-Mode: no-cors",
+		"User-Agent",
+		"Referer",
+		"Accept-Encoding: gzip, deflate",
+		"Connection: keep-alive",
+	},
+	Ws: []string{
+		"Host",
+		"Sec-WebSocket-Extensions: permessage-deflate",
+		"Sec-WebSocket-Key",
+		"Connection: Upgrade",
+		"Upgrade: websocket",
+		"Origin",
+		"Sec-WebSocket-Version: 13",
+		"Pragma: no-cache",
+		"Cache-Control: no-cache",
+		"Cookie",
+		"Accept-Language: en-US,en;q=0.9",
+		"User-Agent",
+		"Accept-Encoding: gzip, deflate, br",
+	},
+}
+
+// name or alias to profile
+var Profiles = map[string]*Profile{
+	"chrome": ProfileChrome,
+	"chrome131": ProfileChrome,
+	"firefox": ProfileFirefox,
+	"firefox133": ProfileFirefox,
+	"safari": ProfileSafari,
+	"safari18": ProfileSafari,
+}
+
+func concat(lists ...[]string) ([]string) {
+	var ret []string
+	for _, l := range lists {
+		ret = append(ret, l...)
+	}
+	return ret
+}
+
+// write HTTP/1.1 request in header order, origin is "scheme://host"
+func (p *Profile) write(w io.Writer, req *http.Request, order []string, origin string) (error) {
+	var b bytes.Buffer
+	b.WriteString(req.Method + " " + req.URL.RequestURI() + " HTTP/1.1\r\n")
+
+	for _, line := range order {
+		name, value := line, ""
+		if i := strings.Index(line, ": "); i >= 0 {
+			name, value = line[:i], line[i + 2:]
+		} else {
+			value = p.value(req, name, origin)
+		}
+		if value == "" {
+			continue
+		}
+		b.WriteString(name + ": " + value + "\r\n")
+	}
+	b.WriteString("\r\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (p *Profile) value(req *http.Request, name string, origin string) (string) {
+	switch http.CanonicalHeaderKey(name) {
+	case "Host":
+		if req.Host != "" {
+			return req.Host
+		}
+		return req.URL.Host
+	case "User-Agent":
+		return p.UserAgent
+	case "Origin":
+		return origin
+	case "Referer":
+		if ref := req.Header.Get("Referer"); ref != "" {
+			return ref
+		}
+		return origin + "/"
+	case "Content-Length":
+		if req.Method != "GET" {
+			return "0" // same as req.Write(), tunnel data after header
+		}
+		return ""
+	}
+	return req.Header.Get(name)
+}
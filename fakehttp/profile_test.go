@@ -0,0 +1,30 @@
+package fakehttp
+
+import (
+	"strings"
+	"testing"
+)
+
+// page body parsed by fetchAssets, ask only codec it can decode
+func TestProfileAcceptEncoding(t *testing.T) {
+	for name, p := range Profiles {
+		for _, list := range [][]string{p.Page, p.Asset} {
+			for _, line := range list {
+				if !strings.HasPrefix(line, "Accept-Encoding:") {
+					continue
+				}
+				for _, v := range strings.Split(strings.TrimPrefix(line, "Accept-Encoding:"), ",") {
+					if v = strings.TrimSpace(v); v != codecGzip && v != codecDeflate {
+						t.Errorf("%s: %q not decoded by fetchAssets", name, v)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNewClientNoJar(t *testing.T) {
+	if cl := NewClient("127.0.0.1:4040"); cl.Jar != nil {
+		t.Fatal("cookie jar should be opt-in")
+	}
+}
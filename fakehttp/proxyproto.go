@@ -0,0 +1,264 @@
+package fakehttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrProxyHeader     = errors.New("invalid PROXY protocol header")
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parse PROXY protocol v1/v2 header from trusted source, others pass through
+type ProxyListener struct {
+	net.Listener
+	Trusted       []*net.IPNet
+	Timeout       time.Duration
+}
+
+func NewProxyListener(lis net.Listener, trusted []*net.IPNet) (*ProxyListener) {
+	return &ProxyListener{
+		Listener: lis,
+		Trusted: trusted,
+		Timeout: timeout,
+	}
+}
+
+func (pl *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !inNets(hostOnly(conn.RemoteAddr().String()), pl.Trusted) {
+		return conn, nil
+	}
+	// parse on first use, not block Accept()
+	return &proxyConn{
+		Conn: conn,
+		br: bufio.NewReader(conn),
+		timeout: pl.Timeout,
+	}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	br       *bufio.Reader
+	once     sync.Once
+	timeout  time.Duration
+	remote   net.Addr
+	err      error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			Vlogln(2, "PROXY header from", c.Conn.RemoteAddr(), "err:", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() (net.Addr) {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// return nil address if no header or LOCAL/UNKNOWN
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, _ := br.Peek(len(proxyV2Sig))
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(br)
+	}
+	return nil, nil
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, 107)
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	isV6 := strings.Contains(fields[2], ":") // IPv4-mapped is TCP6
+	if ip == nil || isV6 != (fields[1] == "TCP6") || net.ParseIP(fields[3]) == nil {
+		return nil, ErrProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12] >> 4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0x0F {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, ErrProxyHeader
+	}
+
+	switch hdr[13] & 0x0F {
+	case 0: // UNSPEC, keep peer address
+		return nil, nil
+	case 1: // STREAM
+	default: // DGRAM or unknown, not for TCP
+		return nil, ErrProxyHeader
+	}
+
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	case 0, 3: // UNSPEC, UNIX
+		return nil, nil
+	}
+	return nil, ErrProxyHeader
+}
+
+// write PROXY protocol header (version 1 or 2) before any data to dst
+func WriteProxyHeader(w io.Writer, version int, src net.Addr, dst net.Addr) (error) {
+	srcAddr := toTCPAddr(src)
+	dstAddr := toTCPAddr(dst)
+
+	isV4 := false
+	if srcAddr != nil && dstAddr != nil {
+		isV4 = srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+	}
+
+	var buf []byte
+	switch version {
+	case 1:
+		if srcAddr == nil || dstAddr == nil {
+			buf = []byte("PROXY UNKNOWN\r\n")
+			break
+		}
+		proto, srcIP, dstIP := "TCP6", ipv6String(srcAddr.IP), ipv6String(dstAddr.IP)
+		if isV4 {
+			proto, srcIP, dstIP = "TCP4", srcAddr.IP.String(), dstAddr.IP.String()
+		}
+		buf = []byte("PROXY " + proto + " " + srcIP + " " + dstIP + " " + strconv.Itoa(srcAddr.Port) + " " + strconv.Itoa(dstAddr.Port) + "\r\n")
+
+	case 2:
+		buf = append(buf, proxyV2Sig...)
+		switch {
+		case srcAddr == nil || dstAddr == nil:
+			buf = append(buf, 0x20, 0x00, 0, 0) // LOCAL
+		case isV4:
+			buf = append(buf, 0x21, 0x11, 0, 12)
+			buf = append(buf, srcAddr.IP.To4()...)
+			buf = append(buf, dstAddr.IP.To4()...)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(srcAddr.Port))
+			buf = binary.BigEndian.AppendUint16(buf, uint16(dstAddr.Port))
+		default:
+			buf = append(buf, 0x21, 0x21, 0, 36)
+			buf = append(buf, srcAddr.IP.To16()...)
+			buf = append(buf, dstAddr.IP.To16()...)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(srcAddr.Port))
+			buf = binary.BigEndian.AppendUint16(buf, uint16(dstAddr.Port))
+		}
+
+	default:
+		return ErrProxyHeader
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// accept "ip:port" or "ip" from ConnAddr
+func toTCPAddr(addr net.Addr) (*net.TCPAddr) {
+	if addr == nil {
+		return nil
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+	str := addr.String()
+	host, portStr, err := net.SplitHostPort(str)
+	if err != nil {
+		host, portStr = str, "0"
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+// keep IPv4-mapped address in IPv6 form for TCP6
+func ipv6String(ip net.IP) (string) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,158 @@
+package fakehttp
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func v2Header(verCmd byte, famProto byte, body []byte) (string) {
+	buf := append([]byte(nil), proxyV2Sig...)
+	buf = append(buf, verCmd, famProto, byte(len(body) >> 8), byte(len(body)))
+	return string(append(buf, body...))
+}
+
+var v2Body4 = []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+var v2Body6 = append(append(append([]byte(nil), net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0x30, 0x39, 0x01, 0xbb)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		addr   string // empty for nil
+		err    bool
+	}{
+		{"none", "GET / HTTP/1.1\r\n", "", false},
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 443\r\n", "192.0.2.1:12345", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", "[2001:db8::1]:12345", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 unknown with address", "PROXY UNKNOWN 1.1.1.1 2.2.2.2 1 2\r\n", "", false},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v1 bad family", "PROXY UDP4 192.0.2.1 10.0.0.1 12345 443\r\n", "", true},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 10.0.0.1 12345 443\r\n", "", true},
+		{"v1 tcp6 with ipv4", "PROXY TCP6 192.0.2.1 10.0.0.1 12345 443\r\n", "", true},
+		{"v1 bad ip", "PROXY TCP4 192.0.2 10.0.0.1 12345 443\r\n", "", true},
+		{"v1 bad dst ip", "PROXY TCP4 192.0.2.1 x 12345 443\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 10.0.0.1 123456 443\r\n", "", true},
+		{"v1 bad dst port", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 x\r\n", "", true},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 10.0.0.1 12345\r\n", "", true},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1", "", true},
+		{"v2 inet", v2Header(0x21, 0x11, v2Body4), "192.0.2.1:12345", false},
+		{"v2 inet6", v2Header(0x21, 0x21, v2Body6), "[2001:db8::1]:12345", false},
+		{"v2 inet with tlv", v2Header(0x21, 0x11, append(append([]byte(nil), v2Body4...), 0x04, 0, 1, 0)), "192.0.2.1:12345", false},
+		{"v2 local", v2Header(0x20, 0x00, nil), "", false},
+		{"v2 local with body", v2Header(0x20, 0x11, v2Body4), "", false},
+		{"v2 unspec", v2Header(0x21, 0x00, nil), "", false},
+		{"v2 unix", v2Header(0x21, 0x31, make([]byte, 216)), "", false},
+		{"v2 bad version", v2Header(0x11, 0x11, v2Body4), "", true},
+		{"v2 bad command", v2Header(0x22, 0x11, v2Body4), "", true},
+		{"v2 dgram", v2Header(0x21, 0x12, v2Body4), "", true},
+		{"v2 bad transport", v2Header(0x21, 0x13, v2Body4), "", true},
+		{"v2 bad family", v2Header(0x21, 0x41, v2Body4), "", true},
+		{"v2 short inet", v2Header(0x21, 0x11, v2Body4[:8]), "", true},
+		{"v2 short inet6", v2Header(0x21, 0x21, v2Body6[:20]), "", true},
+		{"v2 truncated body", v2Header(0x21, 0x11, v2Body4)[:20], "", true},
+		{"v2 truncated header", v2Header(0x21, 0x11, v2Body4)[:14], "", true},
+	}
+	for _, tt := range tests {
+		addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.in)))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.addr {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.addr)
+		}
+	}
+}
+
+// data after header is not consumed
+func TestReadProxyHeaderRest(t *testing.T) {
+	for _, hdr := range []string{"", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 443\r\n", v2Header(0x21, 0x11, v2Body4)} {
+		br := bufio.NewReader(strings.NewReader(hdr + "GET / HTTP/1.1\r\n"))
+		if _, err := readProxyHeader(br); err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := ioutil.ReadAll(br)
+		if string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%q: rest %q", hdr, rest)
+		}
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	tests := []struct {
+		src   net.Addr
+		dst   net.Addr
+		out   string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, "192.0.2.1:12345"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, "[2001:db8::1]:12345"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, "192.0.2.1:12345"}, // as IPv4-mapped
+		{(*StrAddr)(&ConnAddr{Addr: "192.0.2.1"}), &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, "192.0.2.1:0"},
+		{nil, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, ""},
+	}
+	for _, version := range []int{1, 2} {
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			if err := WriteProxyHeader(&buf, version, tt.src, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			addr, err := readProxyHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Errorf("v%d %v: err %v", version, tt.src, err)
+				continue
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.out {
+				t.Errorf("v%d %v: got %q, want %q", version, tt.src, got, tt.out)
+			}
+		}
+	}
+	if err := WriteProxyHeader(&bytes.Buffer{}, 3, nil, nil); err != ErrProxyHeader {
+		t.Error("unknown version accepted")
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	trusted, _ := ParseCIDRs("127.0.0.1")
+	pl := NewProxyListener(lis, trusted)
+
+	go func() {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 443\r\nhello"))
+		conn.Close()
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr := conn.RemoteAddr().String(); addr != "192.0.2.1:12345" {
+		t.Errorf("got %q", addr)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	if string(data) != "hello" {
+		t.Errorf("data %q", data)
+	}
+}
@@ -0,0 +1,127 @@
+package fakehttp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const (
+	nonceSize = 8
+	flagMacSize = 12
+)
+
+// flag cookie value: base64(nonce + HMAC(key, token + method + nonce)), unique per request
+// key from flag and PSK, without PSK anyone know TxFlag/RxFlag can make one
+func mkFlag(flag string, psk []byte, token string, method string) (string) {
+	buf := make([]byte, nonceSize, nonceSize + flagMacSize)
+	rand.Read(buf)
+	buf = append(buf, flagMac(flag, psk, token, method, buf)...)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// return nonce if value signed by flag & psk
+func checkFlag(value string, flag string, psk []byte, token string, method string) (string, bool) {
+	buf, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(buf) != nonceSize + flagMacSize {
+		return "", false
+	}
+	nonce := buf[:nonceSize]
+	if !hmac.Equal(buf[nonceSize:], flagMac(flag, psk, token, method, nonce)) {
+		return "", false
+	}
+	return string(nonce), true
+}
+
+func flagMac(flag string, psk []byte, token string, method string, nonce []byte) ([]byte) {
+	key := []byte(flag)
+	if psk != nil {
+		mac := hmac.New(sha256.New, psk)
+		mac.Write([]byte("flag"))
+		mac.Write(key)
+		key = mac.Sum(nil)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	mac.Write([]byte(method))
+	mac.Write(nonce)
+	return mac.Sum(nil)[:flagMacSize]
+}
+
+// remember seen nonce until ttl, drop oldest when full so flood not lock out real client
+type replayCache struct {
+	mx      sync.Mutex
+	seen    map[string]time.Time
+	order   []string
+}
+
+func newReplayCache() (*replayCache) {
+	return &replayCache{
+		seen: make(map[string]time.Time),
+	}
+}
+
+// return false if nonce already used, keep at most size (<= 0 for unlimited) nonce
+func (rc *replayCache) add(nonce string, size int, ttl time.Duration) (bool) {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+
+	now := time.Now()
+	rc.clean(now)
+
+	if _, ok := rc.seen[nonce]; ok {
+		return false
+	}
+	if size > 0 && len(rc.seen) >= size {
+		rc.cleanAll(now)
+		if len(rc.seen) >= size {
+			Vlogln(3, "replay cache full, drop oldest:", size)
+			n := len(rc.seen) - size + 1
+			for _, old := range rc.order[:n] {
+				delete(rc.seen, old)
+			}
+			rc.order = append([]string(nil), rc.order[n:]...)
+		}
+	}
+	rc.seen[nonce] = now.Add(ttl)
+	rc.order = append(rc.order, nonce)
+	return true
+}
+
+func (rc *replayCache) Clean() {
+	rc.mx.Lock()
+	rc.clean(time.Now())
+	rc.mx.Unlock()
+}
+
+// nonce added in time order, only check from oldest, may keep some with shorter ttl
+func (rc *replayCache) clean(now time.Time) {
+	n := 0
+	for _, nonce := range rc.order {
+		if now.Before(rc.seen[nonce]) {
+			break
+		}
+		delete(rc.seen, nonce)
+		n++
+	}
+	if n > 0 {
+		rc.order = append([]string(nil), rc.order[n:]...)
+	}
+}
+
+// check all, for nonce with different ttl
+func (rc *replayCache) cleanAll(now time.Time) {
+	order := rc.order[:0]
+	for _, nonce := range rc.order {
+		if now.Before(rc.seen[nonce]) {
+			order = append(order, nonce)
+		} else {
+			delete(rc.seen, nonce)
+		}
+	}
+	rc.order = order
+}
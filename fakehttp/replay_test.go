@@ -0,0 +1,185 @@
+package fakehttp
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCheckFlag(t *testing.T) {
+	psk := []byte("secret")
+	value := mkFlag(rxFlag, psk, "token", "GET")
+
+	tests := []struct {
+		name   string
+		value  string
+		flag   string
+		psk    []byte
+		token  string
+		method string
+		ok     bool
+	}{
+		{"valid", value, rxFlag, psk, "token", "GET", true},
+		{"other flag", value, txFlag, psk, "token", "GET", false},
+		{"no psk", value, rxFlag, nil, "token", "GET", false},
+		{"other psk", value, rxFlag, []byte("other"), "token", "GET", false},
+		{"other token", value, rxFlag, psk, "token2", "GET", false},
+		{"other method", value, rxFlag, psk, "token", "POST", false},
+		{"static flag", rxFlag, rxFlag, psk, "token", "GET", false},
+		{"not base64", "!!!", rxFlag, psk, "token", "GET", false},
+		{"empty", "", rxFlag, psk, "token", "GET", false},
+	}
+	for _, tt := range tests {
+		_, ok := checkFlag(tt.value, tt.flag, tt.psk, tt.token, tt.method)
+		if ok != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestCheckFlagNoPSK(t *testing.T) {
+	value := mkFlag(txFlag, nil, "token", "POST")
+	if _, ok := checkFlag(value, txFlag, nil, "token", "POST"); !ok {
+		t.Fatal("valid flag rejected")
+	}
+	if _, ok := checkFlag(value, txFlag, []byte("secret"), "token", "POST"); ok {
+		t.Fatal("flag without psk accepted by server with psk")
+	}
+}
+
+func TestCheckFlagTamper(t *testing.T) {
+	buf, _ := base64.StdEncoding.DecodeString(mkFlag(rxFlag, nil, "token", "GET"))
+	for i := range buf {
+		b := append([]byte(nil), buf...)
+		b[i] ^= 1
+		if _, ok := checkFlag(base64.StdEncoding.EncodeToString(b), rxFlag, nil, "token", "GET"); ok {
+			t.Fatalf("tampered byte %d accepted", i)
+		}
+	}
+	if _, ok := checkFlag(base64.StdEncoding.EncodeToString(buf[:len(buf) - 1]), rxFlag, nil, "token", "GET"); ok {
+		t.Fatal("truncated flag accepted")
+	}
+}
+
+func TestFlagNonceUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		nonce, ok := checkFlag(mkFlag(rxFlag, nil, "token", "GET"), rxFlag, nil, "token", "GET")
+		if !ok {
+			t.Fatal("valid flag rejected")
+		}
+		if seen[nonce] {
+			t.Fatal("nonce repeated")
+		}
+		seen[nonce] = true
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	rc := newReplayCache()
+	if !rc.add("a", 10, time.Minute) {
+		t.Fatal("new nonce rejected")
+	}
+	if rc.add("a", 10, time.Minute) {
+		t.Fatal("replay accepted")
+	}
+	if !rc.add("b", 10, time.Minute) {
+		t.Fatal("other nonce rejected")
+	}
+}
+
+func TestReplayCacheExpire(t *testing.T) {
+	rc := newReplayCache()
+	rc.add("a", 10, 10 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if !rc.add("a", 10, time.Minute) {
+		t.Fatal("expired nonce still remembered")
+	}
+}
+
+// flooding fresh nonce drop oldest, new handshake still accepted
+func TestReplayCacheFull(t *testing.T) {
+	rc := newReplayCache()
+	rc.add("old", 3, time.Minute)
+	rc.add("x1", 3, time.Minute)
+	rc.add("x2", 3, time.Minute)
+	for i := 0; i < 10; i++ {
+		if !rc.add(string(rune('a' + i)), 3, time.Minute) {
+			t.Fatal("new nonce rejected when full")
+		}
+	}
+	if len(rc.seen) != 3 || len(rc.order) != 3 {
+		t.Fatalf("size %d %d, want 3", len(rc.seen), len(rc.order))
+	}
+	if !rc.add("old", 3, time.Minute) {
+		t.Fatal("oldest not dropped")
+	}
+	if rc.add("j", 3, time.Minute) {
+		t.Fatal("replay of newest accepted")
+	}
+}
+
+func TestReplayCacheFullExpired(t *testing.T) {
+	rc := newReplayCache()
+	rc.add("long", 2, time.Minute)
+	rc.add("short", 2, 10 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if !rc.add("new", 2, time.Minute) { // "short" expired behind "long"
+		t.Fatal("nonce rejected after expire")
+	}
+	if rc.add("long", 2, time.Minute) {
+		t.Fatal("replay accepted")
+	}
+}
+
+func TestReplayCacheUnlimited(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		rc := newReplayCache()
+		for i := 0; i < 100; i++ {
+			if !rc.add(string(rune('A' + i)), size, time.Minute) {
+				t.Fatalf("size %d: new nonce rejected", size)
+			}
+		}
+		if rc.add("A", size, time.Minute) {
+			t.Fatalf("size %d: replay accepted", size)
+		}
+	}
+}
+
+func TestServerCheckFlag(t *testing.T) {
+	srv := NewServer(nil)
+	srv.PSK = []byte("secret")
+	vh := &srv.VHost
+
+	value := mkFlag(vh.TxFlag, srv.PSK, "token", "POST")
+	flag, ok := srv.checkFlag(vh, value, "token", "POST")
+	if !ok || flag != vh.TxFlag {
+		t.Fatalf("got %q %v, want TxFlag", flag, ok)
+	}
+	if _, ok := srv.checkFlag(vh, value, "token", "POST"); ok {
+		t.Fatal("replay accepted")
+	}
+	if _, ok := srv.checkFlag(vh, vh.TxFlag, "token", "POST"); ok {
+		t.Fatal("static flag accepted without LegacyFlag")
+	}
+}
+
+// flag without PSK made by anyone, flood must not lock out real client
+func TestServerCheckFlagFlood(t *testing.T) {
+	srv := NewServer(nil)
+	srv.ReplayCacheSize = 4
+	vh := &srv.VHost
+
+	for i := 0; i < 20; i++ {
+		if _, ok := srv.checkFlag(vh, mkFlag(vh.TxFlag, nil, "junk", "POST"), "junk", "POST"); !ok {
+			t.Fatal("flood flag rejected")
+		}
+	}
+	value := mkFlag(vh.TxFlag, nil, "token", "POST")
+	if _, ok := srv.checkFlag(vh, value, "token", "POST"); !ok {
+		t.Fatal("real client locked out after flood")
+	}
+	if _, ok := srv.checkFlag(vh, value, "token", "POST"); ok {
+		t.Fatal("replay accepted")
+	}
+}
@@ -0,0 +1,145 @@
+package fakehttp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// frame size normalized to one of these
+var shapeSizes = []int{256, 512, 1024, 1400, 4096, 8192, 16384}
+
+// frame: 2 bytes data length + 2 bytes padding length + data + random padding
+// header is plaintext without Encrypt, anyone on path can strip the padding
+type shapeConn struct {
+	net.Conn
+	budget   float64 // max padding / data ratio
+
+	rmx      sync.Mutex
+	rBuf     []byte
+
+	wmx      sync.Mutex
+	dataSent int64
+	padSent  int64
+}
+
+func newShapeConn(conn net.Conn, budget float64) (net.Conn) {
+	return &shapeConn{
+		Conn: conn,
+		budget: budget,
+	}
+}
+
+// random delay once per app write, put above compress so flush not sleep again
+type jitterConn struct {
+	net.Conn
+	jitter   time.Duration
+}
+
+func newJitterConn(conn net.Conn, jitter time.Duration) (net.Conn) {
+	if jitter <= 0 {
+		return conn
+	}
+	return &jitterConn{
+		Conn: conn,
+		jitter: jitter,
+	}
+}
+
+func (c *jitterConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(mrand.Int63n(int64(c.jitter))))
+	return c.Conn.Write(b)
+}
+
+func (c *shapeConn) Read(b []byte) (int, error) {
+	c.rmx.Lock()
+	defer c.rmx.Unlock()
+
+	for len(c.rBuf) == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(hdr[0:2]))
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		pad := int64(binary.BigEndian.Uint16(hdr[2:4]))
+		if _, err := io.CopyN(ioutil.Discard, c.Conn, pad); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		c.rBuf = buf // may be padding only frame
+	}
+
+	n := copy(b, c.rBuf)
+	c.rBuf = c.rBuf[n:]
+	return n, nil
+}
+
+func (c *shapeConn) Write(b []byte) (int, error) {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+
+	maxData := shapeSizes[len(shapeSizes) - 1] - 4
+	total := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxData {
+			n = maxData
+		}
+		pad := c.padSize(n)
+
+		buf := make([]byte, 4 + n + pad)
+		binary.BigEndian.PutUint16(buf[0:2], uint16(n))
+		binary.BigEndian.PutUint16(buf[2:4], uint16(pad))
+		copy(buf[4:], b[:n])
+		rand.Read(buf[4 + n:])
+
+		if _, err := c.Conn.Write(buf); err != nil {
+			return total, err
+		}
+		c.dataSent += int64(n)
+		c.padSent += int64(pad)
+		total += n
+		b = b[n:]
+	}
+	return total, nil
+}
+
+// pad up to a normal size, sometimes one size more, within budget
+func (c *shapeConn) padSize(n int) (int) {
+	size := 4 + n
+	for i, s := range shapeSizes {
+		if s < size {
+			continue
+		}
+		if i + 1 < len(shapeSizes) && mrand.Intn(4) == 0 {
+			s = shapeSizes[i + 1]
+		}
+		size = s
+		break
+	}
+	pad := size - 4 - n
+
+	allow := int(c.budget * float64(c.dataSent + int64(n))) + shapeCredit - int(c.padSent)
+	if pad > allow {
+		pad = allow
+	}
+	if pad < 0 {
+		pad = 0
+	}
+	return pad
+}
+
+// frame cut after header is truncated, not clean close
+func unexpectedEOF(err error) (error) {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package fakehttp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShapeRoundTrip(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	w := newShapeConn(c1, 0.5)
+	r := newShapeConn(c2, 0.5)
+
+	msgs := [][]byte{
+		[]byte("a"),
+		bytes.Repeat([]byte("x"), 1000),
+		bytes.Repeat([]byte("y"), 3 * 16384 + 5), // split to frames
+	}
+	go func() {
+		for _, m := range msgs {
+			w.Write(m)
+		}
+	}()
+	for _, m := range msgs {
+		buf := make([]byte, len(m))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, m) {
+			t.Fatalf("data mismatch, len %d", len(m))
+		}
+	}
+}
+
+// parse frames written, return data and padding length of each
+func shapeFrames(t *testing.T, b []byte) ([][2]int) {
+	var list [][2]int
+	for len(b) > 0 {
+		if len(b) < 4 {
+			t.Fatalf("short frame header %d", len(b))
+		}
+		n := int(binary.BigEndian.Uint16(b[0:2]))
+		pad := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4 + n + pad {
+			t.Fatalf("short frame %d < %d", len(b), 4 + n + pad)
+		}
+		list = append(list, [2]int{n, pad})
+		b = b[4 + n + pad:]
+	}
+	return list
+}
+
+func TestShapeSize(t *testing.T) {
+	rc := &recordConn{}
+	conn := newShapeConn(rc, 100) // budget not limit
+	for _, n := range []int{1, 100, 300, 1300, 5000} {
+		conn.Write(make([]byte, n))
+		for _, f := range shapeFrames(t, rc.buf.Bytes()) {
+			size := 4 + f[0] + f[1]
+			found := false
+			for _, s := range shapeSizes {
+				if s == size {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("write %d: frame size %d not normalized", n, size)
+			}
+		}
+		rc.buf.Reset()
+	}
+}
+
+func TestShapeBudget(t *testing.T) {
+	rc := &recordConn{}
+	budget := 0.2
+	conn := newShapeConn(rc, budget)
+	data := 0
+	for i := 0; i < 500; i++ {
+		conn.Write(make([]byte, 10))
+		data += 10
+	}
+	pad := 0
+	for _, f := range shapeFrames(t, rc.buf.Bytes()) {
+		pad += f[1]
+	}
+	if limit := int(budget * float64(data)) + shapeCredit; pad > limit {
+		t.Fatalf("padding %d over budget %d", pad, limit)
+	}
+
+	// zero budget pad only within credit
+	rc.buf.Reset()
+	conn = newShapeConn(rc, 0)
+	for i := 0; i < 500; i++ {
+		conn.Write(make([]byte, 10))
+	}
+	pad = 0
+	for _, f := range shapeFrames(t, rc.buf.Bytes()) {
+		pad += f[1]
+	}
+	if pad > shapeCredit {
+		t.Fatalf("padding %d over credit %d with zero budget", pad, shapeCredit)
+	}
+}
+
+func TestShapeTruncate(t *testing.T) {
+	rc := &recordConn{}
+	newShapeConn(rc, 100).Write([]byte("hello"))
+	frame := rc.buf.Bytes()
+
+	for _, n := range []int{1, 4, 6, len(frame) - 1} {
+		conn := newShapeConn(&replayConn{r: bytes.NewReader(frame[:n])}, 0)
+		if _, err := io.ReadAll(conn); err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated to %d: err %v", n, err)
+		}
+	}
+
+	// padding only frame skipped
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 3, 1, 2, 3})
+	buf.Write(frame)
+	out, err := io.ReadAll(newShapeConn(&replayConn{r: &buf}, 0))
+	if err != nil || string(out) != "hello" {
+		t.Fatalf("padding frame: %q %v", out, err)
+	}
+}
+
+// one sleep for each app write, not each frame of flush
+type countConn struct {
+	net.Conn
+	n int
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	c.n++
+	return len(b), nil
+}
+
+func TestJitterConn(t *testing.T) {
+	cc := &countConn{}
+	if conn := newJitterConn(cc, 0); conn != net.Conn(cc) {
+		t.Fatal("zero jitter should not wrap")
+	}
+	conn := newJitterConn(cc, 20 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		conn.Write([]byte("x"))
+	}
+	if d := time.Since(start); d > 100 * time.Millisecond + 50 * time.Millisecond {
+		t.Fatalf("5 writes took %v", d)
+	}
+	if cc.n != 5 {
+		t.Fatalf("write count %d", cc.n)
+	}
+}
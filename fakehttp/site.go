@@ -0,0 +1,142 @@
+package fakehttp
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"html"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed site
+var siteFS embed.FS
+
+const (
+	defaultTheme = "corp"
+)
+
+var (
+	ErrNoTheme         = errors.New("no such theme")
+)
+
+// built-in decoy site, no directory listing, 404 page like real site
+type siteHandler struct {
+	root     fs.FS
+	fs       http.FileSystem
+	files    http.Handler
+	notFound []byte
+}
+
+// name of built-in themes
+func Themes() ([]string) {
+	var list []string
+	entries, _ := siteFS.ReadDir("site")
+	for _, e := range entries {
+		if e.IsDir() {
+			list = append(list, e.Name())
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// empty theme for default
+func NewSiteHandler(theme string) (http.Handler, error) {
+	if theme == "" {
+		theme = defaultTheme
+	}
+	sub, err := fs.Sub(siteFS, "site/" + theme)
+	if err != nil {
+		return nil, ErrNoTheme
+	}
+	if _, err := fs.Stat(sub, "index.html"); err != nil {
+		return nil, ErrNoTheme
+	}
+	notFound, _ := fs.ReadFile(sub, "404.html")
+	hfs := http.FS(sub)
+	return &siteHandler{
+		root: sub,
+		fs: hfs,
+		files: http.FileServer(hfs),
+		notFound: notFound,
+	}, nil
+}
+
+// ./www if exist, or built-in site
+func defaultHandler() (http.Handler) {
+	if st, err := os.Stat("./www"); err == nil && st.IsDir() {
+		return http.FileServer(http.Dir("./www"))
+	}
+	h, _ := NewSiteHandler("")
+	return h
+}
+
+func (h *siteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	if name == "/robots.txt" || name == "/sitemap.xml" {
+		if h.serveAbs(w, r, name) {
+			return
+		}
+	}
+
+	if !h.isFile(name) {
+		// "/about" for "/about.html"
+		if path.Ext(name) == "" && h.isFile(name + ".html") {
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path = name + ".html"
+			r2.URL = &u
+			h.files.ServeHTTP(w, r2)
+			return
+		}
+		h.serveNotFound(w)
+		return
+	}
+	h.files.ServeHTTP(w, r)
+}
+
+func (h *siteHandler) isFile(name string) (bool) {
+	f, err := h.fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	return err == nil && !st.IsDir()
+}
+
+func (h *siteHandler) serveNotFound(w http.ResponseWriter) {
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(h.notFound)
+}
+
+// crawlers need absolute URL, files keep path only, fill in per Host
+func (h *siteHandler) serveAbs(w http.ResponseWriter, r *http.Request, name string) (bool) {
+	buf, err := fs.ReadFile(h.root, name[1:])
+	if err != nil {
+		return false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+	buf = bytes.ReplaceAll(buf, []byte("Sitemap: /"), []byte("Sitemap: " + base + "/"))
+	buf = bytes.ReplaceAll(buf, []byte("<loc>/"), []byte("<loc>" + html.EscapeString(base) + "/"))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(buf))
+	return true
+}
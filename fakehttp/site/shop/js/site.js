@@ -0,0 +1,12 @@
+(function () {
+	var links = document.querySelectorAll("nav a");
+	for (var i = 0; i < links.length; i++) {
+		if (links[i].pathname === location.pathname) {
+			links[i].style.color = getComputedStyle(document.querySelector("header h1 a")).color;
+		}
+	}
+	var year = document.querySelector("footer");
+	if (year) {
+		year.setAttribute("data-loaded", new Date().getFullYear());
+	}
+})();
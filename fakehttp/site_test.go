@@ -0,0 +1,109 @@
+package fakehttp
+
+import (
+	"crypto/tls"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func siteGet(h http.Handler, path string) (*httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestThemes(t *testing.T) {
+	if got, want := Themes(), []string{"blog", "corp", "shop"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Themes() = %v, want %v", got, want)
+	}
+	for _, name := range Themes() {
+		if _, err := NewSiteHandler(name); err != nil {
+			t.Errorf("theme %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"nope", "../site", "corp/css"} {
+		if _, err := NewSiteHandler(name); err != ErrNoTheme {
+			t.Errorf("theme %q: err %v, want ErrNoTheme", name, err)
+		}
+	}
+}
+
+func TestSiteHandler(t *testing.T) {
+	h, err := NewSiteHandler("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	about, _ := fs.ReadFile(siteFS, "site/" + defaultTheme + "/about.html")
+	index, _ := fs.ReadFile(siteFS, "site/" + defaultTheme + "/index.html")
+	notFound, _ := fs.ReadFile(siteFS, "site/" + defaultTheme + "/404.html")
+
+	for _, tc := range []struct {
+		path   string
+		code   int
+		body   []byte
+	}{
+		{"/", http.StatusOK, index},
+		{"/about", http.StatusOK, about},
+		{"/about.html", http.StatusOK, about},
+		{"/nope", http.StatusNotFound, notFound},
+		{"/nope.html", http.StatusNotFound, notFound},
+		{"/css/", http.StatusNotFound, notFound}, // no directory listing
+		{"/css", http.StatusNotFound, notFound},
+		{"/../about", http.StatusOK, about},
+	} {
+		w := siteGet(h, tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s: status %d, want %d", tc.path, w.Code, tc.code)
+		}
+		if w.Body.String() != string(tc.body) {
+			t.Errorf("%s: unexpected body %.60q", tc.path, w.Body.String())
+		}
+		if tc.code == http.StatusNotFound && w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("%s: 404 Content-Type %q", tc.path, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestSiteAbsURL(t *testing.T) {
+	h, err := NewSiteHandler("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tls    bool
+		base   string
+	}{
+		{false, "http://site.test"},
+		{true, "https://site.test"},
+	} {
+		r := httptest.NewRequest("GET", "/robots.txt", nil)
+		r.Host = "site.test"
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), "Sitemap: " + tc.base + "/sitemap.xml\n") {
+			t.Errorf("robots.txt: %q", w.Body.String())
+		}
+
+		r = httptest.NewRequest("GET", "/sitemap.xml", nil)
+		r.Host = "site.test"
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || strings.Contains(body, "<loc>/") || !strings.Contains(body, "<loc>" + tc.base + "/about.html</loc>") {
+			t.Errorf("sitemap.xml %d: %q", w.Code, body)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, "xml") {
+			t.Errorf("sitemap.xml Content-Type %q", ct)
+		}
+	}
+}
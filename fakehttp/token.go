@@ -0,0 +1,162 @@
+package fakehttp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	pskNonceSize = 12
+	pskMacSize = 16
+)
+
+// token from pre-shared key: base64(nonce + unix time + HMAC(key, nonce + time)), no GET needed
+func mkPSKToken(key []byte) (string) {
+	buf := make([]byte, pskNonceSize + 4, pskNonceSize + 4 + pskMacSize)
+	rand.Read(buf[:pskNonceSize])
+	binary.BigEndian.PutUint32(buf[pskNonceSize:], uint32(time.Now().Unix()))
+	buf = append(buf, pskMac(key, buf)...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// check signature and time (allow clock skew in ttl)
+func checkPSKToken(key []byte, token string, ttl time.Duration) (bool) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != pskNonceSize + 4 + pskMacSize {
+		return false
+	}
+	msg := buf[:pskNonceSize + 4]
+	if !hmac.Equal(buf[pskNonceSize + 4:], pskMac(key, msg)) {
+		return false
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint32(buf[pskNonceSize:])), 0)
+	diff := time.Since(ts)
+	return diff < ttl && diff > -ttl
+}
+
+func pskMac(key []byte, msg []byte) ([]byte) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("token"))
+	mac.Write(msg)
+	return mac.Sum(nil)[:pskMacSize]
+}
+
+// token fetched in background, each one used once
+type tokenCache struct {
+	mx       sync.Mutex
+	list     []cachedToken
+	wake     chan struct{}
+	once     sync.Once
+}
+
+type cachedToken struct {
+	token    string
+	ttl      time.Time
+}
+
+// return empty if none
+func (tc *tokenCache) pop() (string) {
+	now := time.Now()
+	tc.mx.Lock()
+	defer tc.mx.Unlock()
+
+	for len(tc.list) > 0 {
+		t := tc.list[0]
+		tc.list = tc.list[1:]
+		if now.Before(t.ttl) {
+			return t.token
+		}
+	}
+	return ""
+}
+
+func (tc *tokenCache) notify() {
+	select {
+	case tc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drop expired, return count and time of next expire
+func (tc *tokenCache) clean() (int, time.Time) {
+	now := time.Now()
+	tc.mx.Lock()
+	defer tc.mx.Unlock()
+
+	list := tc.list[:0]
+	for _, t := range tc.list {
+		if now.Before(t.ttl) {
+			list = append(list, t)
+		}
+	}
+	tc.list = list
+	if len(list) == 0 {
+		return 0, time.Time{}
+	}
+	return len(list), list[0].ttl
+}
+
+func (cl *Client) startPrefetch() {
+	tc := cl.tokenCache()
+	tc.once.Do(func() {
+		tc.wake = make(chan struct{}, 1)
+		go cl.prefetch(tc)
+	})
+}
+
+// keep Prefetch tokens, each usable for half of server's TokenTTL
+func (cl *Client) prefetch(tc *tokenCache) {
+	backoff := backoffMin
+	for {
+		n, next := tc.clean()
+		if n < cl.Prefetch {
+			token, err := cl.getToken()
+			if err != nil {
+				Vlogln(2, "prefetch token err:", err, "retry after", backoff)
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > poolBackoffMax {
+					backoff = poolBackoffMax
+				}
+				continue
+			}
+			backoff = backoffMin
+
+			tc.mx.Lock()
+			tc.list = append(tc.list, cachedToken{token, time.Now().Add(cl.TokenTTL / 2)})
+			tc.mx.Unlock()
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-tc.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// pre-shared key, prefetched, or get one now
+func (cl *Client) nextToken() (string, error) {
+	if cl.PSK != nil {
+		return mkPSKToken(cl.PSK), nil
+	}
+
+	if cl.Prefetch > 0 {
+		cl.startPrefetch()
+		tc := cl.tokenCache()
+		token := tc.pop()
+		tc.notify()
+		if token != "" {
+			return token, nil
+		}
+	}
+
+	return cl.getToken()
+}
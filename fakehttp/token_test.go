@@ -0,0 +1,130 @@
+package fakehttp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func pskTokenAt(key []byte, ts time.Time) (string) {
+	buf := make([]byte, pskNonceSize + 4, pskNonceSize + 4 + pskMacSize)
+	binary.BigEndian.PutUint32(buf[pskNonceSize:], uint32(ts.Unix()))
+	buf = append(buf, pskMac(key, buf)...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func TestPSKToken(t *testing.T) {
+	key := []byte("secret")
+	ttl := 20 * time.Second
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		token  string
+		key    []byte
+		ok     bool
+	}{
+		{"valid", mkPSKToken(key), key, true},
+		{"other key", mkPSKToken(key), []byte("other"), false},
+		{"in skew", pskTokenAt(key, now.Add(-ttl / 2)), key, true},
+		{"expired", pskTokenAt(key, now.Add(-2 * ttl)), key, false},
+		{"future", pskTokenAt(key, now.Add(2 * ttl)), key, false},
+		{"not base64", "!!!", key, false},
+		{"empty", "", key, false},
+		{"server token", randStringBytes(16), key, false},
+	}
+	for _, tt := range tests {
+		if ok := checkPSKToken(tt.key, tt.token, ttl); ok != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestPSKTokenTamper(t *testing.T) {
+	key := []byte("secret")
+	buf, _ := base64.RawURLEncoding.DecodeString(mkPSKToken(key))
+	if len(buf) != pskNonceSize + 4 + pskMacSize {
+		t.Fatalf("token length %d", len(buf))
+	}
+	for i := range buf {
+		b := append([]byte(nil), buf...)
+		b[i] ^= 1
+		if checkPSKToken(key, base64.RawURLEncoding.EncodeToString(b), time.Minute) {
+			t.Fatalf("tampered byte %d accepted", i)
+		}
+	}
+	for _, n := range []int{len(buf) - 1, pskNonceSize + 4 + 5} {
+		if checkPSKToken(key, base64.RawURLEncoding.EncodeToString(buf[:n]), time.Minute) {
+			t.Fatalf("truncated to %d accepted", n)
+		}
+	}
+}
+
+func TestPSKTokenUnique(t *testing.T) {
+	key := []byte("secret")
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		token := mkPSKToken(key)
+		if seen[token] {
+			t.Fatal("token repeated")
+		}
+		seen[token] = true
+	}
+}
+
+// both leg share one registered state, used token not accepted again
+func TestServerPSKTokenReuse(t *testing.T) {
+	srv := NewServer(nil)
+	srv.PSK = []byte("secret")
+	token := mkPSKToken(srv.PSK)
+
+	c1, ok := srv.checkPSKToken(token, "192.0.2.1", "")
+	if !ok {
+		t.Fatal("valid token rejected")
+	}
+	c2, ok := srv.checkPSKToken(token, "192.0.2.1", "")
+	if !ok || c1 != c2 {
+		t.Fatal("other leg not get same state")
+	}
+
+	srv.rmToken(token)
+	if _, ok := srv.checkPSKToken(token, "192.0.2.1", ""); ok {
+		t.Fatal("used token accepted again")
+	}
+	if _, ok := srv.checkPSKToken(mkPSKToken([]byte("other")), "192.0.2.1", ""); ok {
+		t.Fatal("token of other key accepted")
+	}
+}
+
+func TestClientTokenCache(t *testing.T) {
+	cl := &Client{} // not from NewClient
+	tc := cl.tokenCache()
+	if tc == nil || cl.tokenCache() != tc {
+		t.Fatal("token cache not created once")
+	}
+	if tc.pop() != "" {
+		t.Fatal("new cache not empty")
+	}
+}
+
+func TestClientShare(t *testing.T) {
+	o := NewClient("127.0.0.1:1")
+	cl := NewClient("127.0.0.1:1")
+	if err := cl.Share(o); err != nil {
+		t.Fatal(err)
+	}
+	if cl.tokenCache() != o.tokenCache() {
+		t.Fatal("token cache not shared")
+	}
+
+	late := NewClient("127.0.0.1:1")
+	late.Timeout = time.Second
+	late.Dial() // fail, still count as dialed
+	if err := late.Share(o); err != ErrShareAfterDial {
+		t.Fatalf("Share after Dial: %v", err)
+	}
+	if late.tokenCache() == o.tokenCache() {
+		t.Fatal("token cache changed after Dial")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"net"
 	"io"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -85,9 +88,50 @@ func mkconn(p1 net.Conn, p2 net.Conn, rbuf []byte) (net.Conn){
 }
 
 
+// chunked response body, Close() end it before close
+type chunkConn struct {
+	net.Conn
+	mx     sync.Mutex
+	closed bool
+}
+
+func newChunkConn(conn net.Conn) (net.Conn) {
+	return &chunkConn{Conn: conn}
+}
+
+func (c *chunkConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil // empty chunk end the body
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	buf := make([]byte, 0, len(b) + 16)
+	buf = strconv.AppendInt(buf, int64(len(b)), 16)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, b...)
+	buf = append(buf, "\r\n"...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *chunkConn) Close() (error) {
+	c.mx.Lock()
+	if !c.closed {
+		c.closed = true
+		c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+		c.Conn.Write([]byte("0\r\n\r\n"))
+	}
+	c.mx.Unlock()
+	return c.Conn.Close()
+}
+
 type ConnAddr struct {
 	net.Conn //io.WriteCloser
 	Addr string
+	Host string // VHost.Name
+	Path string // URL path of tunnel request
 }
 func (c *ConnAddr) RemoteAddr() net.Addr {
 	return (*StrAddr)(c)
@@ -107,15 +151,98 @@ func (c *StrAddr) String() string {
 	return c.Addr
 }
 
-func mkConnAddr(p1 net.Conn, address string) (net.Conn) {
-	if address != "" {
-		conn := &ConnAddr{
-			Conn: p1,
-			Addr: address,
+func mkConnAddr(p1 net.Conn, address string, host string, path string) (net.Conn) {
+	conn := &ConnAddr{
+		Conn: p1,
+		Addr: address,
+		Host: host,
+		Path: path,
+	}
+	return conn
+}
+
+// VHost.Name of conn from Server.Accept(), empty for default
+func VHostOf(conn net.Conn) (string) {
+	if c, ok := conn.(*ConnAddr); ok {
+		return c.Host
+	}
+	return ""
+}
+
+// URL path of conn from Server.Accept()
+func PathOf(conn net.Conn) (string) {
+	if c, ok := conn.(*ConnAddr); ok {
+		return c.Path
+	}
+	return ""
+}
+
+// strip port from "host:port", keep as is if no port
+func hostOnly(hostport string) (string) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// parse comma separated CIDR list, single IP as /32 or /128
+func ParseCIDRs(str string) ([]*net.IPNet, error) {
+	var list []*net.IPNet
+	for _, v := range strings.Split(str, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ipnet)
+	}
+	return list, nil
+}
+
+func inNets(ipStr string, list []*net.IPNet) (bool) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range list {
+		if ipnet.Contains(ip) {
+			return true
 		}
-		return conn
 	}
-	return p1
+	return false
+}
+
+// check 2 IP in same network by prefix length
+func sameNet(ip1 string, ip2 string, prefix4 int, prefix6 int) (bool) {
+	a := net.ParseIP(ip1)
+	b := net.ParseIP(ip2)
+	if a == nil || b == nil {
+		return ip1 == ip2
+	}
+
+	mask := net.CIDRMask(prefix6, 128)
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		if a4 == nil || b4 == nil {
+			return false
+		}
+		a, b = a4, b4
+		mask = net.CIDRMask(prefix4, 32)
+	}
+	if mask == nil {
+		return a.Equal(b)
+	}
+	return a.Mask(mask).Equal(b.Mask(mask))
 }
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/-_"
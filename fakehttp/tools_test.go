@@ -0,0 +1,39 @@
+package fakehttp
+
+import (
+	"testing"
+)
+
+func TestSameNet(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		p4, p6   int
+		want     bool
+	}{
+		{"192.0.2.1", "192.0.2.1", 32, 128, true},
+		{"192.0.2.1", "192.0.2.2", 32, 128, false},
+		{"192.0.2.1", "192.0.2.254", 24, 128, true},
+		{"192.0.2.1", "192.0.3.1", 24, 128, false},
+		{"192.0.2.1", "198.51.100.1", 0, 128, true},
+		{"2001:db8::1", "2001:db8::1", 32, 128, true},
+		{"2001:db8::1", "2001:db8::2", 32, 128, false},
+		{"2001:db8:0:1::1", "2001:db8:0:1:ffff::1", 32, 64, true},
+		{"2001:db8:0:1::1", "2001:db8:0:2::1", 32, 64, false},
+		{"2001:db8:0:1::1", "2001:db8:0:2::1", 32, 48, true},
+		{"192.0.2.1", "2001:db8::1", 0, 0, false}, // v4 & v6 never same
+		{"2001:db8::1", "192.0.2.1", 0, 0, false},
+		{"::ffff:192.0.2.1", "192.0.2.1", 32, 128, true}, // v4-mapped as v4
+		{"::ffff:192.0.2.1", "192.0.2.9", 24, 128, true},
+		{"::ffff:192.0.2.1", "192.0.3.1", 24, 0, false}, // by v4 prefix, not v6
+		{"192.0.2.1", "192.0.2.2", 33, 128, false}, // bad prefix, exact match
+		{"192.0.2.1", "192.0.2.1", 33, 128, true},
+		{"bad", "bad", 24, 64, true},
+		{"bad", "192.0.2.1", 0, 0, false},
+		{"", "", 24, 64, true},
+	}
+	for _, tt := range tests {
+		if got := sameNet(tt.a, tt.b, tt.p4, tt.p6); got != tt.want {
+			t.Errorf("sameNet(%q, %q, %d, %d) = %v, want %v", tt.a, tt.b, tt.p4, tt.p6, got, tt.want)
+		}
+	}
+}
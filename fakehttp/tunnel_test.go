@@ -0,0 +1,430 @@
+package fakehttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server behind httptest, echo every accepted tunnel; wrap act as middlebox
+func newTestTunnel(t *testing.T, wrap func(http.Handler) (http.Handler)) (*Server, *httptest.Server) {
+	srv := NewHandle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html>hello</html>")
+	}))
+	var h http.Handler = srv
+	if wrap != nil {
+		h = wrap(srv)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return srv, ts
+}
+
+func newTestClient(ts *httptest.Server) (*Client) {
+	cl := NewClient(strings.TrimPrefix(ts.URL, "http://"))
+	cl.Timeout = 500 * time.Millisecond
+	return cl
+}
+
+// write some data and read it back from echo
+func checkEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, size := range []int{1, 1000, 100000} {
+		data := bytes.Repeat([]byte("0123456789abcdef"), size / 16 + 1)[:size]
+		go conn.Write(data)
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("echo %d: %v", size, err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("echo %d: data mismatch", size)
+		}
+	}
+}
+
+func isWsReq(r *http.Request) (bool) {
+	return r.Header.Get("Upgrade") == "websocket"
+}
+
+// middlebox answer ws as normal page, no 101
+func stripUpgrade(h http.Handler) (http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWsReq(r) {
+			io.WriteString(w, "<html>hello</html>")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// middlebox hold response of tunnel request, match by cookie C
+func holdBack(ws bool, rx bool) (func(http.Handler) (http.Handler)) {
+	return func(h http.Handler) (http.Handler) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := r.Cookie(tokenCookieC)
+			if err == nil && ((ws && isWsReq(r)) || (rx && !isWsReq(r) && r.Method == rxMethod)) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					io.Copy(io.Discard, conn) // until client give up
+					conn.Close()
+				}
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestAutoModeWs(t *testing.T) {
+	_, ts := newTestTunnel(t, nil)
+	cl := newTestClient(ts)
+	cl.AutoMode = true
+	conn, err := cl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+	if cl.Mode() != ModeWs {
+		t.Fatalf("mode %q, want ws first", cl.Mode())
+	}
+}
+
+func TestAutoModeStripUpgrade(t *testing.T) {
+	_, ts := newTestTunnel(t, stripUpgrade)
+	cl := newTestClient(ts)
+
+	token, err := cl.dialToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.dialMode(token, ModeWs); err != ErrBadResponse {
+		t.Fatalf("stripped 101: %v, want ErrBadResponse", err)
+	}
+
+	cl.AutoMode = true
+	conn, err := cl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	if cl.Mode() != ModeHttp {
+		t.Fatalf("mode %q, want fallback to http", cl.Mode())
+	}
+	if modes := cl.autoModes(); modes[0] != ModeHttp || modes[1] != ModeWs {
+		t.Fatalf("worked mode not first: %v", modes)
+	}
+}
+
+func TestAutoModeHoldBack(t *testing.T) {
+	_, ts := newTestTunnel(t, holdBack(true, false))
+	cl := newTestClient(ts)
+	cl.AutoMode = true
+
+	start := time.Now()
+	conn, err := cl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	if cl.Mode() != ModeHttp {
+		t.Fatalf("mode %q, want fallback to http", cl.Mode())
+	}
+	if d := time.Since(start); d < cl.Timeout || d > 3 * cl.Timeout {
+		t.Fatalf("fallback after %v, want about Timeout %v", d, cl.Timeout)
+	}
+}
+
+func TestAutoModeAllFail(t *testing.T) {
+	_, ts := newTestTunnel(t, holdBack(true, true))
+	cl := newTestClient(ts)
+	cl.AutoMode = true
+	if conn, err := cl.Dial(); err == nil {
+		conn.Close()
+		t.Fatal("dial ok with all mode held")
+	}
+	if cl.Mode() != "" {
+		t.Fatalf("mode %q set without success", cl.Mode())
+	}
+}
+
+// one TCP connection seen by tapProxy
+type tapConn struct {
+	up     bytes.Buffer // client to server
+	down   bytes.Buffer // server to client
+	done   chan struct{} // server side closed
+}
+
+// TCP proxy in front of ts, record bytes of each connection
+type tapProxy struct {
+	lis    net.Listener
+	mx     sync.Mutex
+	conns  []*tapConn
+}
+
+func newTapProxy(t *testing.T, target string) (*tapProxy) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &tapProxy{lis: lis}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			s, err := net.Dial("tcp", target)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			tc := &tapConn{done: make(chan struct{})}
+			tp.mx.Lock()
+			tp.conns = append(tp.conns, tc)
+			tp.mx.Unlock()
+			go func() {
+				io.Copy(io.MultiWriter(s, lockedWriter{&tp.mx, &tc.up}), c)
+				s.(*net.TCPConn).CloseWrite()
+			}()
+			go func() {
+				// keep reading after client gone, to see how server end the body
+				buf := make([]byte, 32 * 1024)
+				for {
+					n, err := s.Read(buf)
+					tp.mx.Lock()
+					tc.down.Write(buf[:n])
+					tp.mx.Unlock()
+					c.Write(buf[:n])
+					if err != nil {
+						break
+					}
+				}
+				c.Close()
+				s.Close()
+				close(tc.done)
+			}()
+		}
+	}()
+	return tp
+}
+
+type lockedWriter struct {
+	mx  *sync.Mutex
+	w   io.Writer
+}
+
+func (lw lockedWriter) Write(b []byte) (int, error) {
+	lw.mx.Lock()
+	defer lw.mx.Unlock()
+	return lw.w.Write(b)
+}
+
+// server to client bytes of tunnel leg answer with Rx (ws or http)
+func (tp *tapProxy) rxStream(t *testing.T) ([]byte) {
+	tp.mx.Lock()
+	conns := append([]*tapConn(nil), tp.conns...)
+	tp.mx.Unlock()
+	for _, tc := range conns {
+		tp.mx.Lock()
+		up := append([]byte(nil), tc.up.Bytes()...)
+		tp.mx.Unlock()
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(up)))
+		if err != nil || req.Method != rxMethod {
+			continue
+		}
+		if _, err := req.Cookie(tokenCookieC); err != nil {
+			continue // page for token
+		}
+		select {
+		case <-tc.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("server not end Rx leg")
+		}
+		tp.mx.Lock()
+		defer tp.mx.Unlock()
+		return append([]byte(nil), tc.down.Bytes()...)
+	}
+	t.Fatal("no Rx leg seen")
+	return nil
+}
+
+// decode Rx as header claim, return body after decode
+func decodeRx(t *testing.T, raw []byte) ([]byte, string) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal("Rx response:", err)
+	}
+	var r io.Reader = res.Body
+	enc := res.Header.Get("Content-Encoding")
+	switch {
+	case res.StatusCode == http.StatusSwitchingProtocols:
+		if len(res.TransferEncoding) > 0 || enc != "" {
+			t.Fatalf("101 with body framing: %v %q", res.TransferEncoding, enc)
+		}
+		r = br // raw stream after header
+		if hasCookie(res, compCookie) && !hasCookie(res, keyCookie) && !hasCookie(res, shapeCookie) { // deflate inside crypt/shape
+			enc = codecDeflate
+			r = flate.NewReader(br)
+		}
+	case enc == codecGzip:
+		if len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+			t.Fatalf("Rx not chunked: %v", res.TransferEncoding)
+		}
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatal("Rx gzip:", err)
+		}
+		r = gz
+	case enc != "":
+		t.Fatalf("unexpected Content-Encoding %q", enc)
+	default:
+		if len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+			t.Fatalf("Rx not chunked: %v", res.TransferEncoding)
+		}
+	}
+	body, err := io.ReadAll(r) // error if chunk, gzip trailer or final block missing
+	if err != nil {
+		t.Fatalf("Rx body %q: %v", enc, err)
+	}
+	return body, enc
+}
+
+// Dial via tapProxy, echo, return Rx as decoded by its header
+func tapRoundTrip(t *testing.T, ws bool, setup func(*Server, *Client)) ([]byte, string) {
+	srv, ts := newTestTunnel(t, nil)
+	tp := newTapProxy(t, strings.TrimPrefix(ts.URL, "http://"))
+	cl := NewClient(tp.lis.Addr().String())
+	cl.Timeout = 2 * time.Second
+	cl.UseWs = ws
+	setup(srv, cl)
+
+	conn, err := cl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+
+	return decodeRx(t, tp.rxStream(t))
+}
+
+// Dial to Accept, each mode & compress; Rx on wire valid as its header say
+func TestTunnelRoundTrip(t *testing.T) {
+	for _, ws := range []bool{true, false} {
+		for _, comp := range []bool{false, true} {
+			body, enc := tapRoundTrip(t, ws, func(srv *Server, cl *Client) {
+				srv.Compress = true
+				cl.Compress = comp
+			})
+			wantEnc := ""
+			if comp && ws {
+				wantEnc = codecDeflate
+			} else if comp {
+				wantEnc = codecGzip
+			}
+			if enc != wantEnc {
+				t.Errorf("ws %v compress %v: encoding %q, want %q", ws, comp, enc, wantEnc)
+			}
+			if want := 1 + 1000 + 100000; len(body) != want {
+				t.Errorf("ws %v compress %v: Rx body %d bytes, want %d", ws, comp, len(body), want)
+			}
+		}
+	}
+}
+
+// gzip under crypt must not be claimed by Content-Encoding
+func TestTunnelCompressEncrypt(t *testing.T) {
+	for _, ws := range []bool{true, false} {
+		_, enc := tapRoundTrip(t, ws, func(srv *Server, cl *Client) {
+			srv.Compress = true
+			srv.Encrypt = true
+			cl.Compress = true
+			cl.Encrypt = true
+		})
+		if enc != "" {
+			t.Errorf("ws %v: encoding %q under encrypt", ws, enc)
+		}
+	}
+}
+
+// shape pad outside compress, end to end still echo, gzip not claimed
+func TestTunnelCompressShape(t *testing.T) {
+	for _, ws := range []bool{true, false} {
+		for _, enc := range []bool{false, true} {
+			_, ce := tapRoundTrip(t, ws, func(srv *Server, cl *Client) {
+				srv.Compress = true
+				srv.Shape = true
+				cl.Compress = true
+				cl.Shape = true
+				cl.Encrypt = enc
+			})
+			if ce != "" {
+				t.Errorf("ws %v encrypt %v: encoding %q under shape", ws, enc, ce)
+			}
+		}
+	}
+}
+
+// server not claim gzip for encrypted or shaped leg, even client ask
+func TestServerNoGzipLayered(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		enc    bool
+		shape  bool
+		want   string
+	}{
+		{"plain", false, false, codecGzip},
+		{"encrypt", true, false, ""},
+		{"shape", false, true, ""},
+	} {
+		srv, ts := newTestTunnel(t, nil)
+		srv.Compress = true
+		srv.Shape = true
+		cl := newTestClient(ts)
+		cl.Compress = true
+		cl.Shape = tc.shape
+		token, err := cl.getToken()
+		if err != nil {
+			t.Fatal(tc.name, err)
+		}
+		pub := ""
+		if tc.enc {
+			_, pub, _ = newKeyPair()
+		}
+		rx, res, err := cl.getRx(token, cl.extCookie(pub), nil)
+		if err != nil {
+			t.Fatal(tc.name, err)
+		}
+		if got := res.Header.Get("Content-Encoding"); got != tc.want {
+			t.Errorf("%s: Content-Encoding %q, want %q", tc.name, got, tc.want)
+		}
+		rx.Close()
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"net"
+	"net/url"
+	"net/http/cookiejar"
 	"flag"
+	"strconv"
 	"io"
 	"io/ioutil"
+	"strings"
 	"sync"
+	"time"
 	"os"
 	"runtime"
 	"log"
@@ -18,8 +23,20 @@ var verbosity int = 2
 var copyBuf sync.Pool
 
 var port = flag.String("p", "127.0.0.1:5005", "bind port")
-var target = flag.String("t", "127.0.0.1:4040", "http server address & port")
+var target = flag.String("t", "127.0.0.1:4040", "http server address & port, comma separated in priority order for failover, or URL with own settings: https://host:port/path?ws=1&auto=1&crt=ca.crt&k=0&sni=&host=&dial=")
+var spread = flag.Bool("spread", false, "spread new tunnel across healthy servers, not priority order")
+var backoff = flag.Duration("backoff", 1*time.Second, "retry delay after server fail, double each fail, 0 for no backoff")
+var maxBackoff = flag.Duration("maxbackoff", 5*time.Minute, "max retry delay for failed server, 0 for no limit")
+var psk = flag.String("psk", "", "pre-shared key same as server, make token without request, also sign handshake")
+var prefetch = flag.Int("prefetch", 0, "keep tokens fetched in background, 0 to disable")
+var tokenTTL = flag.Duration("tokenttl", 20*time.Second, "server's token TTL for -prefetch")
+var poolSize = flag.Int("pool", 0, "keep ready tunnels, 0 to disable")
+var poolIdle = flag.Duration("poolidle", 60*time.Second, "recycle ready tunnel after idle, should less than server/target timeout")
+var probe = flag.Duration("probe", 30*time.Second, "re-probe failed server interval, 0 to disable")
 var targetUrl = flag.String("url", "/", "http url to send")
+var dialAddr = flag.String("dial", "", "tcp address to connect (default: same as -t)")
+var hostHeader = flag.String("host", "", "http header: Host (default: same as -t)")
+var sni = flag.String("sni", "", "TLS server name (default: hostname of Host)")
 
 var crtFile    = flag.String("crt", "", "PEM encoded certificate file")
 
@@ -27,14 +44,43 @@ var tokenCookieA = flag.String("ca", "cna", "token cookie name A")
 var tokenCookieB = flag.String("cb", "_tb_token_", "token cookie name B")
 var tokenCookieC = flag.String("cc", "_cna", "token cookie name C")
 
-var userAgent = flag.String("ua", "Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/47.0.2526.80 Safari/537.36 QQBrowser/9.3.6874.400", "User-Agent (default: QQ)")
+var userAgent = flag.String("ua", "Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/47.0.2526.80 Safari/537.36 QQBrowser/9.3.6874.400", "User-Agent (default: QQ), not used with -profile")
+var profile = flag.String("profile", "", "browser headers to mimic: chrome, firefox, safari; comma separated to rotate")
+var jar = flag.Bool("jar", true, "keep cookies set by site and send back like browser")
+var cover = flag.Bool("cover", false, "also fetch css/js/img linked by page when get token")
+var revisit = flag.Duration("revisit", 0, "revisit page at random time around this, 0 to disable")
+var rotateUA = flag.Duration("rotate", 0, "pick another -profile after, 0 to keep one")
 
 var wsObf = flag.Bool("usews", false, "fake as websocket")
+var compress = flag.Bool("compress", false, "compress tunnel (server also need -compress for download; http mode off with -encrypt or -shape)")
+var encrypt = flag.Bool("encrypt", false, "end-to-end encrypt tunnel, need -psk to stop MITM (CDN, proxy)")
+var shape = flag.Bool("shape", false, "pad and jitter tunnel if server accept, frame header is plaintext without -encrypt")
+var padBudget = flag.Float64("padbudget", 0.5, "max padding / data ratio for -shape")
+var jitter = flag.Duration("jitter", 0, "max random delay before each app write for -shape")
+var autoMode = flag.Bool("auto", false, "try websocket then 2 connections mode, remember which works")
 var tlsVerify = flag.Bool("k", true, "InsecureSkipVerify")
 
-var cl *fakehttp.Client
+var localMaps multiFlag
+var profiles []*fakehttp.Profile
 
-func handleClient(p1 net.Conn) {
+// same spec use same Client, same server share tokens & TLS sessions
+var clients = make(map[string]*fakehttp.Client)
+var servers = make(map[string]*fakehttp.Client)
+
+type multiFlag []string
+func (l *multiFlag) String() (string) {
+	return strings.Join(*l, " ")
+}
+func (l *multiFlag) Set(v string) (error) {
+	*l = append(*l, v)
+	return nil
+}
+
+func init() {
+	flag.Var(&localMaps, "L", "local port mapping, repeatable: localaddr=server,server...; server same as -t, or /path[?ws=&auto=] on -t servers (default: -p to -t if -p set or no -L)")
+}
+
+func handleClient(p1 net.Conn, cl fakehttp.Dialer) {
 	defer p1.Close()
 
 	p2, err := cl.Dial()
@@ -55,53 +101,271 @@ func main() {
 		Vlogln(2, "Error: token cookie cannot bee same!")
 		os.Exit(1)
 	}
-
-	lis, err := net.Listen("tcp", *port)
-	if err != nil {
-		Vlogln(2, "Error listening:", err.Error())
+	if *encrypt && *psk == "" {
+		Vlogln(2, "-encrypt need -psk, key exchange without it can be replaced by anyone terminate TLS")
 		os.Exit(1)
 	}
-	defer lis.Close()
+	if *shape && !*encrypt {
+		Vlogln(2, "[warn] -shape without -encrypt, padding can be stripped by anyone terminate TLS")
+	}
 
-	Vlogln(2, "listening on:", lis.Addr())
 	Vlogln(2, "target:", *target)
+	Vlogln(2, "dial address:", *dialAddr)
+	Vlogln(2, "Host header:", *hostHeader)
+	Vlogln(2, "SNI:", *sni)
 	Vlogln(2, "token cookie A:", *tokenCookieA)
 	Vlogln(2, "token cookie B:", *tokenCookieB)
 	Vlogln(2, "token cookie C:", *tokenCookieC)
 	Vlogln(2, "use ws:", *wsObf)
+	Vlogln(2, "encrypt:", *encrypt)
+	Vlogln(2, "shape:", *shape, *padBudget, *jitter)
 	Vlogln(2, "use certificate:", *crtFile)
 
-	if *crtFile != "" {
-		caCert, err := ioutil.ReadFile(*crtFile)
-		if err != nil {
-			Vlogln(2, "Reading certificate error:", err)
+	for _, name := range strings.Split(*profile, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, ok := fakehttp.Profiles[name]
+		if !ok {
+			Vlogln(2, "unknown profile:", name)
 			os.Exit(1)
 		}
-		cl = fakehttp.NewTLSClient(*target, caCert, *tlsVerify)
-	} else {
-		cl = fakehttp.NewClient(*target)
+		profiles = append(profiles, p)
 	}
-	cl.TokenCookieA = *tokenCookieA
-	cl.TokenCookieB = *tokenCookieB
-	cl.TokenCookieC = *tokenCookieC
-	cl.UseWs = *wsObf
-	cl.UserAgent = *userAgent
-	cl.Url = *targetUrl
+	Vlogln(2, "profile:", *profile, *rotateUA)
+	Vlogln(2, "cookie jar:", *jar, "cover:", *cover, *revisit)
 
 	copyBuf.New = func() interface{} {
 		return make([]byte, 4096)
 	}
 
+	portSet := len(localMaps) == 0
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			portSet = true
+		}
+	})
+	maps := []string(localMaps)
+	if portSet {
+		maps = append([]string{*port + "=" + *target}, maps...)
+	}
+
+	for _, m := range maps {
+		kv := strings.SplitN(m, "=", 2)
+		if len(kv) != 2 {
+			Vlogln(2, "mapping error:", m)
+			os.Exit(1)
+		}
+		cl, err := mkDialer(kv[1])
+		if err != nil {
+			Vlogln(2, "server setting error:", m, err)
+			os.Exit(1)
+		}
+
+		lis, err := net.Listen("tcp", kv[0])
+		if err != nil {
+			Vlogln(2, "Error listening:", err.Error())
+			os.Exit(1)
+		}
+		Vlogln(2, "listening on:", lis.Addr(), "to", kv[1])
+		go serve(lis, cl)
+	}
+
+	select {}
+}
+
+func serve(lis net.Listener, cl fakehttp.Dialer) {
+	defer lis.Close()
 	for {
 		if conn, err := lis.Accept(); err == nil {
-			Vlogln(2, "remote address:", conn.RemoteAddr())
+			Vlogln(2, "remote address:", conn.RemoteAddr(), "on", lis.Addr())
 
-			go handleClient(conn)
+			go handleClient(conn, cl)
 		} else {
 			Vlogf(2, "%+v", err)
 		}
 	}
+}
+
+// servers of a mapping, "/path" for each -t with that path
+func mkDialer(specs string) (fakehttp.Dialer, error) {
+	var list []*fakehttp.Client
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if !strings.HasPrefix(spec, "/") {
+			c, err := getClient(spec, "")
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, c)
+			continue
+		}
+		for _, srv := range strings.Split(*target, ",") {
+			srv = strings.TrimSpace(srv)
+			if srv == "" {
+				continue
+			}
+			c, err := getClient(srv, spec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, c)
+		}
+	}
+	if len(list) == 0 {
+		return nil, fakehttp.ErrNoServer
+	}
+
+	mc := fakehttp.NewMultiClient(list...)
+	mc.Spread = *spread
+	mc.Backoff = *backoff
+	mc.MaxBackoff = *maxBackoff
+	mc.ProbeInterval = *probe
+
+	if *poolSize > 0 {
+		pool := fakehttp.NewPool(mc, *poolSize)
+		pool.MaxIdle = *poolIdle
+		pool.Start()
+		Vlogln(2, "pool:", *poolSize, *poolIdle)
+		return pool, nil
+	}
+	return mc, nil
+}
+
+func getClient(spec string, route string) (*fakehttp.Client, error) {
+	key := spec + " " + route
+	if c, ok := clients[key]; ok {
+		return c, nil
+	}
+	c, srvKey, err := mkClient(spec, route)
+	if err != nil {
+		return nil, err
+	}
+	if o, ok := servers[srvKey]; ok {
+		if err := c.Share(o); err != nil {
+			return nil, err
+		}
+	} else {
+		servers[srvKey] = c
+	}
+	clients[key] = c
+	return c, nil
+}
+
+// spec: "host:port" with global flags, or URL override them
+// route: "/path?ws=1" override path & query of spec, empty to keep
+// also return key of server, same for Client can share tokens & TLS sessions
+func mkClient(spec string, route string) (*fakehttp.Client, string, error) {
+	addr := spec
+	path := *targetUrl
+	useWs := *wsObf
+	auto := *autoMode
+	caFile := *crtFile
+	useTLS := caFile != ""
+	skipVerify := *tlsVerify
+	serverName := *sni
+	host := *hostHeader
+	dial := *dialAddr
+
+	q := url.Values{}
+	if strings.Contains(spec, "://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, "", err
+		}
+		addr = u.Host
+		useTLS = u.Scheme == "https"
+		if u.Path != "" {
+			path = u.EscapedPath()
+		}
+		q = u.Query()
+	}
+	if route != "" {
+		u, err := url.Parse(route)
+		if err != nil {
+			return nil, "", err
+		}
+		path = u.EscapedPath()
+		for k, v := range u.Query() {
+			q[k] = v
+		}
+	}
+	if v, ok := q["ws"]; ok {
+		useWs = v[0] == "1" || v[0] == "true"
+	}
+	if v, ok := q["auto"]; ok {
+		auto = v[0] == "1" || v[0] == "true"
+	}
+	if v, ok := q["k"]; ok {
+		skipVerify = v[0] == "1" || v[0] == "true"
+	}
+	if v, ok := q["crt"]; ok {
+		caFile = v[0]
+	}
+	if v, ok := q["sni"]; ok {
+		serverName = v[0]
+	}
+	if v, ok := q["host"]; ok {
+		host = v[0]
+	}
+	if v, ok := q["dial"]; ok {
+		dial = v[0]
+	}
+
+	var c *fakehttp.Client
+	if useTLS {
+		var caCert []byte
+		if caFile != "" {
+			var err error
+			caCert, err = ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		c = fakehttp.NewTLSClient(addr, caCert, skipVerify)
+	} else {
+		c = fakehttp.NewClient(addr)
+	}
+	c.TokenCookieA = *tokenCookieA
+	c.TokenCookieB = *tokenCookieB
+	c.TokenCookieC = *tokenCookieC
+	c.UseWs = useWs
+	c.AutoMode = auto
+	c.Compress = *compress
+	c.Encrypt = *encrypt
+	c.Shape = *shape
+	c.ShapeBudget = *padBudget
+	c.ShapeJitter = *jitter
+	c.UserAgent = *userAgent
+	c.Profiles = profiles
+	if *jar {
+		c.Jar, _ = cookiejar.New(nil)
+	}
+	c.Cover = *cover
+	c.CoverInterval = *revisit
+	c.RotateUA = *rotateUA
+	c.Url = path
+	c.Prefetch = *prefetch
+	c.TokenTTL = *tokenTTL
+	if *psk != "" {
+		c.PSK = []byte(*psk)
+	}
+	c.Addr = dial
+	c.ServerName = serverName
+	if host != "" {
+		if c.Addr == "" {
+			c.Addr = addr
+		}
+		c.Host = host
+	}
 
+	Vlogln(2, "server:", addr, "path:", path, "ws:", useWs, "auto:", auto, "tls:", useTLS, caFile)
+	srvKey := strings.Join([]string{addr, dial, host, serverName, caFile, strconv.FormatBool(useTLS), strconv.FormatBool(skipVerify)}, "|")
+	return c, srvKey, nil
 }
 
 func cp(p1, p2 io.ReadWriteCloser) {
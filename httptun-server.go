@@ -1,9 +1,27 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	mrand "math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"io"
@@ -11,7 +29,9 @@ import (
 	"log"
 	"flag"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"./fakehttp"
 )
@@ -20,29 +40,106 @@ var verbosity int = 2
 
 var copyBuf sync.Pool
 
+var targets *targetPool
+var vhostTargets = make(map[string]*targetPool) // by VHost.Name, default to targets
+var vhosts multiFlag
+var routeSpecs multiFlag
+var routes []*route
+
 var port = flag.String("p", ":4040", "http bind port")
-var target = flag.String("t", "127.0.0.1:5002", "real server")
-var dir = flag.String("d", "./www", "web/file server root dir")
+var target = flag.String("t", "127.0.0.1:5002", "real server, comma separated for load balance")
+var lbPolicy = flag.String("lb", "rr", "load balance policy for multiple -t: rr (round-robin), lc (least connections), random")
+var dialTimeout = flag.Duration("dialtimeout", 5*time.Second, "timeout to connect real server")
+var dialRetry = flag.Int("retry", 2, "retry other real server when connect fail")
+var healthInterval = flag.Duration("health", 10*time.Second, "TCP health check interval for real server, 0 to disable")
+var maxFail = flag.Int("maxfail", 3, "eject real server after continuous connect fail")
+var ejectTime = flag.Duration("eject", 30*time.Second, "eject time for -maxfail")
+var dir = flag.String("d", "", "web/file server root dir (default: ./www if exist, or built-in site)")
+var theme = flag.String("theme", "", "built-in site theme when no -d: " + strings.Join(fakehttp.Themes(), ", ") + " (default: corp)")
+var upstream = flag.String("upstream", "", "reverse proxy non-tunnel request to this URL instead of -d, eg: https://example.com")
+var upstreamHost = flag.String("upstreamhost", "", "Host header to -upstream (default: host of -upstream)")
+var decoyCache = flag.Duration("cache", 0, "cache -upstream response for this long, 0 to disable")
+var decoyCacheSize = flag.Int("cachesize", 256, "max cached -upstream response")
 
 var tokenCookieA = flag.String("ca", "cna", "token cookie name A")
 var tokenCookieB = flag.String("cb", "_tb_token_", "token cookie name B")
 var tokenCookieC = flag.String("cc", "_cna", "token cookie name C")
-var headerServer = flag.String("hdsrv", "nginx", "http header: Server")
+var headerServer = flag.String("hdsrv", "nginx", "http header: Server, -upstream page send its own, set same for tunnel")
 var wsObf = flag.Bool("usews", true, "fake as websocket")
 var onlyWs = flag.Bool("onlyws", false, "only accept websocket")
+var trustProxy = flag.String("trustproxy", "", "trusted proxy CIDR, comma separated, only trust -iphdr from these")
+var ipHeader = flag.String("iphdr", "", "http header for client IP from -trustproxy, must be one your proxy overwrite or append to: X-Forwarded-For, X-Real-IP, Forwarded, Cf-Connecting-Ip")
+var bindIP = flag.Bool("bindip", false, "tunnel must come from the address token issued to")
+var bindPrefix4 = flag.Int("bindv4", 32, "IPv4 prefix length treated as same address for -bindip (ex: 24 for carrier NAT)")
+var bindPrefix6 = flag.Int("bindv6", 128, "IPv6 prefix length treated as same address for -bindip (ex: 64)")
+var proxyProto = flag.String("proxyproto", "", "accept PROXY protocol v1/v2 header from these CIDR (ex: load balancer), comma separated, empty to disable")
+var sendProxy = flag.Int("sendproxy", 0, "send PROXY protocol header to target with client address, version: 1, 2, 0 to disable")
+var allowList = flag.String("allow", "", "tunnel only from these CIDR, comma separated, empty for any")
+var denyList = flag.String("deny", "", "no tunnel from these CIDR, comma separated")
+var banMaxFail = flag.Int("banfail", 0, "ban address after fail times (unknown token, mismatch...), 0 to disable")
+var banFindTime = flag.Duration("banfind", 10*time.Minute, "time window to count fail for -banfail")
+var banTime = flag.Duration("bantime", 1*time.Hour, "ban time for -banfail")
+var adminAddr = flag.String("admin", "", "admin http bind address (GET /bans, GET /targets, POST /unban?ip=), empty to disable")
+var psk = flag.String("psk", "", "pre-shared key, client can make token without request, also sign handshake, empty to disable")
+var compress = flag.Bool("compress", false, "compress tunnel if client accept")
+var shape = flag.Bool("shape", false, "pad and jitter tunnel if client ask, frame header is plaintext without -encrypt")
+var padBudget = flag.Float64("padbudget", 0.5, "max padding / data ratio for -shape")
+var jitter = flag.Duration("jitter", 0, "max random delay before each app write for -shape")
+var encrypt = flag.Bool("encrypt", false, "require end-to-end encrypted tunnel, client also need -encrypt, need -psk to stop MITM (CDN, proxy)")
+var legacyFlag = flag.Bool("legacyflag", false, "also accept old client without handshake nonce (replayable)")
+var pairTimeout = flag.Duration("pairtimeout", 3*time.Second, "end http mode leg if other leg not come in this time")
 
 var crtFile    = flag.String("crt", "", "PEM encoded certificate file")
 var keyFile    = flag.String("key", "", "PEM encoded private key file")
+var crtWatch   = flag.Duration("crtwatch", 10*time.Second, "check certificate files for change every, 0 to only reload on SIGHUP")
+
+var genCert    = flag.Bool("gencert", false, "generate CA & certificate to -crt/-key if not exist (or run: httptun-server [flags] gencert)")
+var genCaCrt   = flag.String("gencacrt", "ca.crt", "CA certificate file for -gencert, give this to client -crt")
+var genCaKey   = flag.String("gencakey", "ca.key", "CA private key file for -gencert")
+var genHosts   = flag.String("genhosts", "localhost,127.0.0.1", "hostnames & IPs for -gencert, comma separated")
+var genAlg     = flag.String("genalg", "ecdsa", "key type for -gencert: ecdsa, ed25519")
+var genDays    = flag.Int("gendays", 365, "certificate validity days for -gencert")
+
+var tlsMin     = flag.String("tlsmin", "1.2", "TLS min version: 1.2, 1.3")
+var tlsSuites  = flag.String("tlssuites", "ECDHE-CHACHA20,ECDHE-AESGCM,ECDHE-AESCBC", "TLS 1.2 cipher suites, comma separated names from crypto/tls or groups: ECDHE-CHACHA20, ECDHE-AESGCM, ECDHE-AESCBC, RSA")
+var tlsCurves  = flag.String("tlscurves", "P521,P384,P256", "TLS curves, comma separated: X25519, P256, P384, P521")
+var alpn       = flag.String("alpn", "", "TLS ALPN protocols, comma separated (default: h2,http/1.1)")
+
+// repeatable flag
+type multiFlag []string
+func (l *multiFlag) String() (string) {
+	return strings.Join(*l, " ")
+}
+func (l *multiFlag) Set(v string) (error) {
+	*l = append(*l, v)
+	return nil
+}
+
+func init() {
+	flag.Var(&vhosts, "vhost", "virtual host by Host or SNI, repeatable: host[,alias...][?t=&lb=&d=&theme=&upstream=&upstreamhost=&usews=&onlyws=&ca=&cb=&cc=&hdsrv=&txflag=&rxflag=], unset one same as global")
+	flag.Var(&routeSpecs, "route", "route tunnel by URL path, repeatable: [host]/path=target,target[?lb=&sendproxy=], host must be a -vhost name or alias, path end with / for prefix, longest match first")
+}
 
 func handleClient(p1 net.Conn) {
 	defer p1.Close()
 
-	p2, err := net.DialTimeout("tcp", *target, 5*time.Second)
+	pool, proxyVer := pickTarget(p1)
+	p2, b, err := pool.dial()
 	if err != nil {
-		Vlogln(2, "connect to:", *target, err)
+		Vlogln(2, "connect to:", pool.addrs(), fakehttp.VHostOf(p1), fakehttp.PathOf(p1), err)
 		return
 	}
+	Vlogln(3, "connect to:", b.addr, fakehttp.VHostOf(p1), fakehttp.PathOf(p1))
+	defer pool.done(b)
 	defer p2.Close()
+
+	if proxyVer != 0 {
+		err = fakehttp.WriteProxyHeader(p2, proxyVer, p1.RemoteAddr(), p2.RemoteAddr())
+		if err != nil {
+			Vlogln(2, "send PROXY header to:", b.addr, err)
+			return
+		}
+	}
 	cp(p1, p2)
 	Vlogln(2, "close", p1.RemoteAddr())
 }
@@ -51,36 +148,148 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU() + 2)
 	flag.Parse()
 
+	if *genCert || flag.Arg(0) == "gencert" {
+		if *crtFile == "" {
+			*crtFile = "server.crt"
+		}
+		if *keyFile == "" {
+			*keyFile = "server.key"
+		}
+		if err := genCertFiles(); err != nil {
+			Vlogln(2, "generate certificate error:", err)
+			os.Exit(1)
+		}
+		if flag.Arg(0) == "gencert" {
+			return
+		}
+	}
+
+	if *encrypt && *psk == "" {
+		Vlogln(2, "-encrypt need -psk, key exchange without it can be replaced by anyone terminate TLS")
+		os.Exit(1)
+	}
+	if *shape && !*encrypt {
+		Vlogln(2, "[warn] -shape without -encrypt, padding can be stripped by anyone terminate TLS")
+	}
+
 	Vlogln(2, "listening on:", *port)
-	Vlogln(2, "target:", *target)
-	Vlogln(2, "dir:", *dir)
+	Vlogln(2, "target:", *target, *lbPolicy)
+	Vlogln(2, "dir:", *dir, "theme:", *theme)
+	Vlogln(2, "upstream:", *upstream, *upstreamHost, *decoyCache)
 	Vlogln(2, "token cookie A:", *tokenCookieA)
 	Vlogln(2, "token cookie B:", *tokenCookieB)
 	Vlogln(2, "token cookie C:", *tokenCookieC)
 	Vlogln(2, "use ws:", *wsObf)
 	Vlogln(2, "only ws:", *onlyWs)
+	Vlogln(2, "legacy flag:", *legacyFlag)
+	Vlogln(2, "use psk:", *psk != "")
+	Vlogln(2, "compress:", *compress)
+	Vlogln(2, "encrypt:", *encrypt)
+	Vlogln(2, "shape:", *shape, *padBudget, *jitter)
+	Vlogln(2, "bind IP:", *bindIP, *bindPrefix4, *bindPrefix6)
+	Vlogln(2, "trusted proxy:", *trustProxy, *ipHeader)
+	Vlogln(2, "PROXY protocol from:", *proxyProto)
+	Vlogln(2, "send PROXY protocol:", *sendProxy)
+	Vlogln(2, "allow:", *allowList)
+	Vlogln(2, "deny:", *denyList)
+	Vlogln(2, "ban:", *banMaxFail, *banFindTime, *banTime)
 
 	copyBuf.New = func() interface{} {
 		return make([]byte, 4096)
 	}
 
+	targets = newTargetPool(splitList(*target), *lbPolicy)
+	if targets == nil {
+		Vlogln(2, "unknown load balance policy:", *lbPolicy)
+		os.Exit(1)
+	}
+	go targets.healthCheck(*healthInterval)
+
 
 	// simple http Handler setup
-	fileHandler := http.FileServer(http.Dir(*dir))
+	fileHandler := webHandler()
 	//http.Handle("/", fileHandler) // do not add to http.DefaultServeMux now
 	http.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) { // other Handler
 		io.WriteString(w, "Hello, world!\n")
 	})
 
-	websrv := fakehttp.NewHandle(fileHandler) // bind handler
+	var err error
+	var decoy http.Handler = fileHandler
+	var proxyDecoy *fakehttp.ProxyDecoy
+	if *upstream != "" {
+		proxyDecoy, err = mkProxyDecoy(*upstream, *upstreamHost)
+		if err != nil {
+			Vlogln(2, "parse upstream error:", err)
+			os.Exit(1)
+		}
+		decoy = proxyDecoy
+	}
+
+	websrv := fakehttp.NewHandle(decoy) // bind handler
 	websrv.UseWs = *wsObf
 	websrv.OnlyWs = *onlyWs
+	websrv.LegacyFlag = *legacyFlag
+	websrv.PairTimeout = *pairTimeout
+	websrv.Compress = *compress
+	websrv.Encrypt = *encrypt
+	websrv.Shape = *shape
+	websrv.ShapeBudget = *padBudget
+	websrv.ShapeJitter = *jitter
+	if *psk != "" {
+		websrv.PSK = []byte(*psk)
+	}
+	websrv.IPHeader = *ipHeader
+	if websrv.TrustedProxies, err = fakehttp.ParseCIDRs(*trustProxy); err != nil {
+		Vlogln(2, "parse trusted proxy list error:", err)
+		os.Exit(1)
+	}
+	if (*trustProxy != "") != (*ipHeader != "") {
+		Vlogln(2, "-trustproxy and -iphdr must be set together")
+		os.Exit(1)
+	}
+	if strings.Contains(*ipHeader, ",") {
+		Vlogln(2, "-iphdr take only one header, the one your proxy set")
+		os.Exit(1)
+	}
+	websrv.BindIP = *bindIP
+	websrv.BindPrefix4 = *bindPrefix4
+	websrv.BindPrefix6 = *bindPrefix6
+	websrv.BanMaxFail = *banMaxFail
+	websrv.BanFindTime = *banFindTime
+	websrv.BanTime = *banTime
+	if websrv.Allow, err = fakehttp.ParseCIDRs(*allowList); err != nil {
+		Vlogln(2, "parse allow list error:", err)
+		os.Exit(1)
+	}
+	if websrv.Deny, err = fakehttp.ParseCIDRs(*denyList); err != nil {
+		Vlogln(2, "parse deny list error:", err)
+		os.Exit(1)
+	}
+	if proxyDecoy != nil { // tunnel cookies not leak to upstream
+		proxyDecoy.DropCookies = tunnelCookies(&websrv.VHost)
+	}
+	for _, spec := range vhosts {
+		if err := addVHost(websrv, spec); err != nil {
+			Vlogln(2, "vhost setting error:", spec, err)
+			os.Exit(1)
+		}
+	}
+	for _, spec := range routeSpecs {
+		if err := addRoute(websrv, spec); err != nil {
+			Vlogln(2, "route setting error:", spec, err)
+			os.Exit(1)
+		}
+	}
 	http.Handle("/", websrv) // now add to http.DefaultServeMux
 
 	// start http server
 	srv := &http.Server{Addr: *port, Handler: nil}
 	go startServer(srv)
 
+	if *adminAddr != "" {
+		go startAdmin(websrv)
+	}
+
 	// accept real connections
 	for {
 		if conn, err := websrv.Accept(); err == nil {
@@ -106,7 +315,7 @@ func byListener() {
 	// setup fakehttp
 	websrv := fakehttp.NewServer(lis)
 	websrv.UseWs = *wsObf
-	websrv.HttpHandler = http.FileServer(http.Dir(*dir))
+	websrv.HttpHandler = webHandler()
 	websrv.StartServer()
 
 	// accept real connections
@@ -121,52 +330,843 @@ func byListener() {
 	}
 }
 
-func startServer(srv *http.Server) {
-	var err error
+// -d, ./www, or built-in site
+func webHandler() (http.Handler) {
+	h, err := mkWebHandler(*dir, *theme)
+	if err != nil {
+		Vlogln(2, "web site error:", *dir, *theme, err)
+		os.Exit(1)
+	}
+	return h
+}
 
-	// check tls
-	if *crtFile != "" && *keyFile != "" {
-		cfg := &tls.Config{
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
+// root, ./www if no root and theme, or built-in site
+func mkWebHandler(root string, theme string) (http.Handler, error) {
+	if root == "" && theme == "" && fileExist("./www") {
+		root = "./www"
+	}
+	if root != "" {
+		if !fileExist(root) {
+			return nil, errors.New("dir not found: " + root)
+		}
+		return http.FileServer(http.Dir(root)), nil
+	}
+	return fakehttp.NewSiteHandler(theme)
+}
+
+func mkProxyDecoy(upstream string, host string) (*fakehttp.ProxyDecoy, error) {
+	d, err := fakehttp.NewProxyDecoy(upstream)
+	if err != nil {
+		return nil, err
+	}
+	d.Host = host
+	d.CacheTTL = *decoyCache
+	d.CacheSize = *decoyCacheSize
+	return d, nil
+}
+
+type route struct {
+	host      string // VHost.Name, empty for any
+	path      string
+	pool      *targetPool
+	sendProxy int
+}
+
+// spec: "[host]/path=target,target[?lb=&sendproxy=]", host is a -vhost name or alias
+func addRoute(websrv *fakehttp.Server, spec string) (error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return errors.New("no target")
+	}
+	pattern, dest := spec[:i], spec[i + 1:]
+	j := strings.Index(pattern, "/")
+	if j < 0 {
+		return errors.New("path must start with /")
+	}
+
+	query := ""
+	if k := strings.Index(dest, "?"); k >= 0 {
+		dest, query = dest[:k], dest[k + 1:]
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+
+	rt := &route{
+		path: pattern[j:],
+		sendProxy: *sendProxy,
+	}
+	if host := strings.ToLower(pattern[:j]); host != "" { // VHostOf give VHost.Name
+		vh, ok := websrv.VHosts[host]
+		if !ok {
+			return errors.New("host not set by -vhost: " + host)
+		}
+		rt.host = vh.Name
+	}
+	if v := q.Get("sendproxy"); v != "" {
+		if rt.sendProxy, err = strconv.Atoi(v); err != nil {
+			return err
+		}
+	}
+	lb := *lbPolicy
+	if q.Get("lb") != "" {
+		lb = q.Get("lb")
+	}
+	rt.pool = newTargetPool(splitList(dest), lb)
+	if rt.pool == nil {
+		return errors.New("unknown load balance policy: " + lb)
+	}
+	go rt.pool.healthCheck(*healthInterval)
+	routes = append(routes, rt)
+
+	Vlogln(2, "route:", rt.host + rt.path, "->", dest, "lb:", lb, "send PROXY:", rt.sendProxy)
+	return nil
+}
+
+// by path, then VHost, then -t
+func pickTarget(conn net.Conn) (*targetPool, int) {
+	host, path := fakehttp.VHostOf(conn), fakehttp.PathOf(conn)
+
+	var best *route
+	for _, rt := range routes {
+		if rt.host != "" && rt.host != host {
+			continue
+		}
+		if strings.HasSuffix(rt.path, "/") {
+			if !strings.HasPrefix(path, rt.path) {
+				continue
+			}
+		} else if path != rt.path {
+			continue
+		}
+		if best == nil || len(rt.path) > len(best.path) || (len(rt.path) == len(best.path) && rt.host != "") {
+			best = rt
+		}
+	}
+	if best != nil {
+		Vlogln(3, "route:", host, path, "->", best.host + best.path)
+		return best.pool, best.sendProxy
+	}
+
+	if tp, ok := vhostTargets[host]; ok {
+		return tp, *sendProxy
+	}
+	return targets, *sendProxy
+}
+
+func tunnelCookies(vh *fakehttp.VHost) ([]string) {
+	return []string{vh.TokenCookieA, vh.TokenCookieB, vh.TokenCookieC, vh.KeyCookie, vh.ShapeCookie, vh.CompCookie}
+}
+
+// first name appear more than once, empty if none
+func dupName(list []string) (string) {
+	seen := make(map[string]bool, len(list))
+	for _, v := range list {
+		if seen[v] {
+			return v
+		}
+		seen[v] = true
+	}
+	return ""
+}
+
+// spec: "host[,alias...][?key=value&...]", unset key same as global flag
+func addVHost(websrv *fakehttp.Server, spec string) (error) {
+	names, query := spec, ""
+	if i := strings.Index(spec, "?"); i >= 0 {
+		names, query = spec[:i], spec[i + 1:]
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	list := splitList(names)
+	if len(list) == 0 {
+		return errors.New("no host name")
+	}
+
+	vh := websrv.NewVHost(list...)
+	isTrue := func(v string) (bool) {
+		return v == "1" || v == "true"
+	}
+	if v, ok := q["ca"]; ok {
+		vh.TokenCookieA = v[0]
+	}
+	if v, ok := q["cb"]; ok {
+		vh.TokenCookieB = v[0]
+	}
+	if v, ok := q["cc"]; ok {
+		vh.TokenCookieC = v[0]
+	}
+	if name := dupName(tunnelCookies(vh)); name != "" { // server can not tell which one client mean
+		return errors.New("cookie name used twice: " + name)
+	}
+	if v, ok := q["hdsrv"]; ok {
+		vh.HeaderServer = v[0]
+	}
+	if v, ok := q["txflag"]; ok {
+		vh.TxFlag = v[0]
+	}
+	if v, ok := q["rxflag"]; ok {
+		vh.RxFlag = v[0]
+	}
+	if v, ok := q["usews"]; ok {
+		vh.UseWs = isTrue(v[0])
+	}
+	if v, ok := q["onlyws"]; ok {
+		vh.OnlyWs = isTrue(v[0])
+	}
+
+	switch {
+	case q.Get("upstream") != "":
+		d, err := mkProxyDecoy(q.Get("upstream"), q.Get("upstreamhost"))
+		if err != nil {
+			return err
+		}
+		vh.HttpHandler = d
+	case q.Get("d") != "" || q.Get("theme") != "":
+		h, err := mkWebHandler(q.Get("d"), q.Get("theme"))
+		if err != nil {
+			return err
+		}
+		vh.HttpHandler = h
+	}
+	if d, ok := vh.HttpHandler.(*fakehttp.ProxyDecoy); ok { // may shared with global, drop cookies of every vhost use it
+		for _, name := range tunnelCookies(vh) {
+			if !hasString(d.DropCookies, name) {
+				d.DropCookies = append(d.DropCookies, name)
+			}
+		}
+	}
 
-				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	if v, ok := q["t"]; ok {
+		lb := *lbPolicy
+		if q.Get("lb") != "" {
+			lb = q.Get("lb")
+		}
+		tp := newTargetPool(splitList(v[0]), lb)
+		if tp == nil {
+			return errors.New("unknown load balance policy: " + lb)
+		}
+		go tp.healthCheck(*healthInterval)
+		vhostTargets[vh.Name] = tp
+	}
 
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	Vlogln(2, "vhost:", list, "target:", q.Get("t"), "usews:", vh.UseWs, "onlyws:", vh.OnlyWs)
+	return nil
+}
 
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, // http/2 must
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, // http/2 must
+func startServer(srv *http.Server) {
+	var err error
 
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	lis, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Printf("Listen error: %v", err)
+		os.Exit(1)
+	}
+	if *proxyProto != "" {
+		trusted, err := fakehttp.ParseCIDRs(*proxyProto)
+		if err != nil {
+			log.Printf("parse PROXY protocol source error: %v", err)
+			os.Exit(1)
+		}
+		lis = fakehttp.NewProxyListener(lis, trusted)
+	}
 
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	// check tls
+	if *crtFile != "" && *keyFile != "" {
+		cfg, cerr := mkTLSConfig()
+		if cerr != nil {
+			log.Printf("TLS config error: %v", cerr)
+			os.Exit(1)
+		}
 
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384, // weak
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA, // waek
-			},
+		crt, cerr := newCertReloader(*crtFile, *keyFile)
+		if cerr != nil {
+			log.Printf("Load certificate error: %v", cerr)
+			os.Exit(1)
 		}
+		go crt.watch(*crtWatch)
+		cfg.GetCertificate = crt.GetCertificate
+
 		srv.TLSConfig = cfg
-		//srv.TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0) // disable http/2
+		if cfg.NextProtos != nil && !hasString(cfg.NextProtos, "h2") {
+			srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0) // disable http/2
+		}
 
 		log.Printf("HTTPS server Listen on: %v", *port)
-		err = srv.ListenAndServeTLS(*crtFile, *keyFile)
+		err = srv.ServeTLS(lis, "", "")
 	} else {
 		log.Printf("HTTP server Listen on: %v", *port)
-		err = srv.ListenAndServe()
+		err = srv.Serve(lis)
 	}
 
 	if err != http.ErrServerClosed {
-		log.Printf("ListenAndServe error: %v", err)
+		log.Printf("Serve error: %v", err)
 		os.Exit(1)
 	}
 }
 
+var tlsSuiteGroups = map[string][]uint16{
+	"ECDHE-CHACHA20": []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	},
+	"ECDHE-AESGCM": []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, // http/2 must
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, // http/2 must
+	},
+	"ECDHE-AESCBC": []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	},
+	"RSA": []uint16{ // weak, no forward secrecy
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	},
+}
+
+var tlsCurveNames = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256": tls.CurveP256,
+	"P384": tls.CurveP384,
+	"P521": tls.CurveP521,
+}
+
+func mkTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	switch *tlsMin {
+	case "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unknown TLS version: %v", *tlsMin)
+	}
+
+	// TLS 1.3 suites are not configurable
+	allSuites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, name := range splitList(*tlsSuites) {
+		if list, ok := tlsSuiteGroups[name]; ok {
+			cfg.CipherSuites = append(cfg.CipherSuites, list...)
+			continue
+		}
+		found := false
+		for _, suite := range allSuites {
+			if suite.Name == name {
+				cfg.CipherSuites = append(cfg.CipherSuites, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite: %v", name)
+		}
+	}
+
+	for _, name := range splitList(*tlsCurves) {
+		id, ok := tlsCurveNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %v", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+
+	cfg.NextProtos = splitList(*alpn)
+
+	return cfg, nil
+}
+
+// reload certificate on SIGHUP or file change, existing connections not affected
+type certReloader struct {
+	mx       sync.RWMutex
+	crtFile  string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(crtFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		crtFile: crtFile,
+		keyFile: keyFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() (error) {
+	modTime := cr.getModTime()
+	cert, err := tls.LoadX509KeyPair(cr.crtFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mx.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mx.Unlock()
+	return nil
+}
+
+func (cr *certReloader) getModTime() (time.Time) {
+	var modTime time.Time
+	for _, fp := range []string{cr.crtFile, cr.keyFile} {
+		info, err := os.Stat(fp)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+func (cr *certReloader) watch(interval time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	cr.loop(sig, tick)
+}
+
+func (cr *certReloader) loop(sig <-chan os.Signal, tick <-chan time.Time) {
+	for {
+		select {
+		case _, ok := <-sig:
+			if !ok {
+				return
+			}
+			Vlogln(2, "SIGHUP, reload certificate")
+		case <-tick:
+			cr.mx.RLock()
+			modTime := cr.modTime
+			cr.mx.RUnlock()
+			if !cr.getModTime().After(modTime) {
+				continue
+			}
+			Vlogln(2, "certificate changed, reload")
+		}
+
+		if err := cr.reload(); err != nil {
+			Vlogln(2, "reload certificate error:", err)
+		}
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mx.RLock()
+	defer cr.mx.RUnlock()
+	return cr.cert, nil
+}
+
+type backend struct {
+	addr        string
+	conns       int64
+	fails       int
+	down        bool // by health check
+	ejectUntil  time.Time // by continuous connect fail
+}
+
+// real servers for load balance
+type targetPool struct {
+	mx          sync.Mutex
+	list        []*backend
+	policy      string
+	next        int
+}
+
+func newTargetPool(addrs []string, policy string) (*targetPool) {
+	switch policy {
+	case "rr", "lc", "random":
+	default:
+		return nil
+	}
+	tp := &targetPool{
+		policy: policy,
+	}
+	for _, addr := range addrs {
+		tp.list = append(tp.list, &backend{addr: addr})
+	}
+	return tp
+}
+
+// connect to real server, try another one on fail
+func (tp *targetPool) dial() (net.Conn, *backend, error) {
+	var err error = errors.New("no real server")
+	tried := make(map[*backend]bool)
+	for i := 0; i <= *dialRetry; i++ {
+		b := tp.pick(tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", b.addr, *dialTimeout)
+		if err != nil {
+			Vlogln(2, "connect to:", b.addr, err)
+			tp.fail(b)
+			continue
+		}
+
+		tp.mx.Lock()
+		b.fails = 0
+		tp.mx.Unlock()
+		return conn, b, nil
+	}
+	return nil, nil, err
+}
+
+func (tp *targetPool) addrs() (string) {
+	list := make([]string, 0, len(tp.list))
+	for _, b := range tp.list {
+		list = append(list, b.addr)
+	}
+	return strings.Join(list, ",")
+}
+
+// call after connection from dial() closed
+func (tp *targetPool) done(b *backend) {
+	tp.mx.Lock()
+	b.conns--
+	tp.mx.Unlock()
+}
+
+func (tp *targetPool) pick(tried map[*backend]bool) (*backend) {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+
+	now := time.Now()
+	var list []*backend
+	for _, b := range tp.list {
+		if !tried[b] && !b.down && now.After(b.ejectUntil) {
+			list = append(list, b)
+		}
+	}
+	if len(list) == 0 { // all down, still try
+		for _, b := range tp.list {
+			if !tried[b] {
+				list = append(list, b)
+			}
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+
+	var b *backend
+	switch tp.policy {
+	case "rr":
+		b = list[tp.next % len(list)]
+		tp.next++
+	case "lc":
+		b = list[0]
+		for _, v := range list[1:] {
+			if v.conns < b.conns {
+				b = v
+			}
+		}
+	case "random":
+		b = list[mrand.Intn(len(list))]
+	}
+	b.conns++
+	return b
+}
+
+func (tp *targetPool) fail(b *backend) {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+
+	b.conns--
+	b.fails++
+	if b.fails >= *maxFail {
+		b.fails = 0
+		b.ejectUntil = time.Now().Add(*ejectTime)
+		Vlogln(2, "[lb] eject:", b.addr, "for", *ejectTime)
+	}
+}
+
+func (tp *targetPool) healthCheck(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		for _, b := range tp.list {
+			conn, err := net.DialTimeout("tcp", b.addr, *dialTimeout)
+			if err == nil {
+				conn.Close()
+			}
+
+			tp.mx.Lock()
+			if (err != nil) != b.down {
+				Vlogln(2, "[lb] health check:", b.addr, "down:", err != nil, err)
+			}
+			b.down = err != nil
+			tp.mx.Unlock()
+		}
+	}
+}
+
+func (tp *targetPool) status() (string) {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+
+	var str string
+	for _, b := range tp.list {
+		str += fmt.Sprintf("%v\tconns: %v\tdown: %v\teject until: %v\n", b.addr, b.conns, b.down, b.ejectUntil.Format(time.RFC3339))
+	}
+	return str
+}
+
+// runtime inspect, only bind to trusted address
+func startAdmin(websrv *fakehttp.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		for ip, until := range websrv.Bans() {
+			fmt.Fprintf(w, "%v\t%v\n", ip, until.Format(time.RFC3339))
+		}
+	})
+	mux.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, targets.status())
+		for name, tp := range vhostTargets {
+			io.WriteString(w, "[" + name + "]\n")
+			io.WriteString(w, tp.status())
+		}
+		for _, rt := range routes {
+			io.WriteString(w, "[" + rt.host + rt.path + "]\n")
+			io.WriteString(w, rt.pool.status())
+		}
+	})
+	mux.HandleFunc("/unban", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		ip := r.FormValue("ip")
+		if !websrv.Unban(ip) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		Vlogln(2, "[admin] unban:", ip)
+		io.WriteString(w, "ok\n")
+	})
+
+	log.Printf("admin server Listen on: %v", *adminAddr)
+	err := http.ListenAndServe(*adminAddr, mux)
+	log.Printf("admin ListenAndServe error: %v", err)
+}
+
+// generate CA (if not exist) and server certificate signed by it
+func genCertFiles() (error) {
+	if fileExist(*crtFile) && fileExist(*keyFile) {
+		Vlogln(2, "certificate exist, skip generate:", *crtFile, *keyFile)
+		return printCertInfo(false)
+	}
+
+	hosts := splitList(*genHosts)
+	if len(hosts) == 0 {
+		return errors.New("no hostname for certificate")
+	}
+
+	caCert, caKey, err := loadOrGenCA()
+	if err != nil {
+		return err
+	}
+
+	key, err := genKey(*genAlg)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := certTemplate(hosts[0])
+	if err != nil {
+		return err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	if err := writeCertKey(*crtFile, *keyFile, der, key); err != nil {
+		return err
+	}
+	Vlogln(2, "certificate generated:", *crtFile, *keyFile)
+
+	return printCertInfo(true)
+}
+
+func loadOrGenCA() (*x509.Certificate, crypto.Signer, error) {
+	if fileExist(*genCaCrt) && fileExist(*genCaKey) {
+		pair, err := tls.LoadX509KeyPair(*genCaCrt, *genCaKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		caCert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		caKey, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, errors.New("unsupported CA key")
+		}
+		Vlogln(2, "use exist CA:", *genCaCrt)
+		return caCert, caKey, nil
+	}
+
+	caKey, err := genKey(*genAlg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl, err := certTemplate("httptun CA " + randHex(4))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeCertKey(*genCaCrt, *genCaKey, der, caKey); err != nil {
+		return nil, nil, err
+	}
+	Vlogln(2, "CA generated:", *genCaCrt, *genCaKey)
+
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return caCert, caKey, nil
+}
+
+func genKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type: %v", alg)
+}
+
+func certTemplate(cn string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-1 * time.Hour),
+		NotAfter:     now.AddDate(0, 0, *genDays),
+	}
+	return tmpl, nil
+}
+
+func writeCertKey(crtFile string, keyFile string, der []byte, key crypto.Signer) (error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// print SPKI fingerprint, and example client command if signed by -gencacrt now
+func printCertInfo(generated bool) (error) {
+	pair, err := tls.LoadX509KeyPair(*crtFile, *keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	host := cert.Subject.CommonName
+	if len(cert.DNSNames) > 0 {
+		host = cert.DNSNames[0]
+	} else if len(cert.IPAddresses) > 0 {
+		host = cert.IPAddresses[0].String()
+	}
+	_, p, err := net.SplitHostPort(*port)
+	if err != nil {
+		p = "443"
+	}
+
+	Vlogln(2, "certificate:", *crtFile, "expire:", cert.NotAfter.Format(time.RFC3339))
+	Vlogln(2, "SPKI fingerprint (sha256/base64):", base64.StdEncoding.EncodeToString(spki[:]))
+	if generated {
+		Vlogf(2, "client: ./httptun-client -t \"%v\" -crt \"%v\" -k=false\n", net.JoinHostPort(host, p), *genCaCrt)
+	}
+	return nil
+}
+
+func fileExist(fp string) (bool) {
+	_, err := os.Stat(fp)
+	return err == nil
+}
+
+func randHex(n int) (string) {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return fmt.Sprintf("%x", buf)
+}
+
+func splitList(str string) ([]string) {
+	var list []string
+	for _, v := range strings.Split(str, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func hasString(list []string, str string) (bool) {
+	for _, v := range list {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
+
 func cp(p1, p2 io.ReadWriteCloser) {
 	// start tunnel
 	p1die := make(chan struct{})
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"./fakehttp"
+)
+
+func pickN(tp *targetPool, n int) ([]string) {
+	var list []string
+	for i := 0; i < n; i++ {
+		b := tp.pick(nil)
+		if b == nil {
+			list = append(list, "")
+			continue
+		}
+		list = append(list, b.addr)
+	}
+	return list
+}
+
+func TestTargetPoolPolicy(t *testing.T) {
+	if newTargetPool([]string{"a"}, "bad") != nil {
+		t.Fatal("unknown policy accepted")
+	}
+
+	tp := newTargetPool([]string{"a", "b", "c"}, "rr")
+	got := pickN(tp, 4)
+	want := []string{"a", "b", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("rr: got %v, want %v", got, want)
+		}
+	}
+
+	tp = newTargetPool([]string{"a", "b", "c"}, "lc")
+	tp.list[0].conns = 2
+	tp.list[1].conns = 1
+	tp.list[2].conns = 3
+	if b := tp.pick(nil); b.addr != "b" || b.conns != 2 {
+		t.Fatalf("lc: got %v %v", b.addr, b.conns)
+	}
+	if b := tp.pick(nil); b.addr != "a" && b.addr != "b" {
+		t.Fatalf("lc: got %v", b.addr)
+	}
+
+	tp = newTargetPool([]string{"a", "b"}, "random")
+	for _, addr := range pickN(tp, 20) {
+		if addr != "a" && addr != "b" {
+			t.Fatalf("random: got %q", addr)
+		}
+	}
+}
+
+func TestTargetPoolSkip(t *testing.T) {
+	tp := newTargetPool([]string{"a", "b", "c"}, "rr")
+	tp.list[0].down = true
+	tp.list[1].ejectUntil = time.Now().Add(time.Minute)
+	for _, addr := range pickN(tp, 3) {
+		if addr != "c" {
+			t.Fatalf("got %q, want only healthy one", addr)
+		}
+	}
+
+	// tried one not picked again
+	tried := map[*backend]bool{tp.list[2]: true}
+	if b := tp.pick(tried); b == nil || b.addr == "c" {
+		t.Fatalf("tried one picked: %v", b)
+	}
+
+	// all down, still try
+	tp.list[2].down = true
+	if b := tp.pick(nil); b == nil {
+		t.Fatal("nothing picked when all down")
+	}
+
+	tried = map[*backend]bool{tp.list[0]: true, tp.list[1]: true, tp.list[2]: true}
+	if b := tp.pick(tried); b != nil {
+		t.Fatalf("picked after all tried: %v", b.addr)
+	}
+}
+
+func TestTargetPoolEject(t *testing.T) {
+	tp := newTargetPool([]string{"a"}, "rr")
+	b := tp.list[0]
+	for i := 0; i < *maxFail; i++ {
+		tp.pick(nil)
+		tp.fail(b)
+	}
+	if !time.Now().Before(b.ejectUntil) {
+		t.Fatal("not ejected after -maxfail")
+	}
+	if b.conns != 0 {
+		t.Fatalf("conns %v after fail", b.conns)
+	}
+}
+
+func TestTargetPoolDial(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// closed port first, retry to next one
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	tp := newTargetPool([]string{deadAddr, lis.Addr().String()}, "rr")
+	conn, b, err := tp.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if b.addr != lis.Addr().String() || b.conns != 1 {
+		t.Fatalf("got %v conns %v", b.addr, b.conns)
+	}
+	tp.done(b)
+	if b.conns != 0 || tp.list[0].fails != 1 {
+		t.Fatalf("conns %v fails %v", b.conns, tp.list[0].fails)
+	}
+}
+
+func TestAddVHost(t *testing.T) {
+	*healthInterval = 0
+	d, err := fakehttp.NewProxyDecoy("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	websrv := fakehttp.NewHandle(d)
+	d.DropCookies = tunnelCookies(&websrv.VHost)
+
+	if err := addVHost(websrv, "A.test,alias.test?ca=xa&cb=xb&cc=xc&t=127.0.0.1:1&usews=1"); err != nil {
+		t.Fatal(err)
+	}
+	vh := websrv.VHosts["a.test"]
+	if vh == nil || websrv.VHosts["alias.test"] != vh || vh.Name != "a.test" {
+		t.Fatalf("alias not same vhost: %v", websrv.VHosts)
+	}
+	if vh.TokenCookieA != "xa" || !vh.UseWs || websrv.VHost.TokenCookieA == "xa" {
+		t.Fatalf("vhost setting: %+v", vh)
+	}
+	if _, ok := vhostTargets["a.test"]; !ok {
+		t.Fatal("vhost target not set")
+	}
+
+	// global decoy shared, must drop cookies of both
+	if vh.HttpHandler != http.Handler(d) {
+		t.Fatal("global decoy not inherited")
+	}
+	for _, name := range append(tunnelCookies(&websrv.VHost), "xa", "xb", "xc") {
+		if !hasString(d.DropCookies, name) {
+			t.Errorf("shared decoy not drop %q: %v", name, d.DropCookies)
+		}
+	}
+
+	if err := addVHost(websrv, "b.test?upstream=http://127.0.0.1:2&ca=ya"); err != nil {
+		t.Fatal(err)
+	}
+	own, ok := websrv.VHosts["b.test"].HttpHandler.(*fakehttp.ProxyDecoy)
+	if !ok || own == d || !hasString(own.DropCookies, "ya") || hasString(d.DropCookies, "ya") {
+		t.Fatalf("own decoy: %v", own)
+	}
+
+	if err := addVHost(websrv, "readme.test?upstream=http://127.0.0.1:2&ca=_ga"); err != nil { // README example
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{
+		"",
+		"c.test?ca=same&cb=same",
+		"c.test?ca=same&cc=same",
+		"c.test?cb=same&cc=same",
+		"c.test?ca=" + websrv.KeyCookie,
+		"c.test?cb=" + websrv.ShapeCookie,
+		"c.test?cc=" + websrv.CompCookie,
+		"c.test?ca=" + websrv.TokenCookieB,
+		"c.test?lb=bad&t=127.0.0.1:1",
+		"c.test?d=/not/exist/dir",
+		"c.test?theme=nosuch",
+		"c.test?%zz",
+	} {
+		if err := addVHost(websrv, spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	*healthInterval = 0
+	routes, vhostTargets = nil, make(map[string]*targetPool)
+	defer func() {
+		routes, vhostTargets = nil, make(map[string]*targetPool)
+	}()
+	targets = newTargetPool([]string{"default"}, "rr")
+
+	websrv := fakehttp.NewHandle(nil)
+	if err := addVHost(websrv, "a.test,alias.test?t=vhost-a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{
+		"/api/=api",
+		"/api/v2/=v2",
+		"/exact=exact",
+		"ALIAS.test/api/=a-api?sendproxy=2",
+	} {
+		if err := addRoute(websrv, spec); err != nil {
+			t.Fatal(spec, err)
+		}
+	}
+	for _, spec := range []string{
+		"/x",
+		"nopath=x",
+		"other.test/x=x", // not a vhost, never match
+		"/x=x?lb=bad",
+		"/x=x?sendproxy=v",
+	} {
+		if err := addRoute(websrv, spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+
+	tests := []struct {
+		host   string
+		path   string
+		want   string
+		proxy  int
+	}{
+		{"", "/api/x", "api", 0},
+		{"", "/api/v2/x", "v2", 0},
+		{"", "/api", "default", 0},
+		{"", "/exact", "exact", 0},
+		{"", "/exact/x", "default", 0},
+		{"a.test", "/api/x", "a-api", 2}, // host route first on same path
+		{"a.test", "/api/v2/x", "v2", 0}, // longer path first
+		{"a.test", "/other", "vhost-a", 0},
+	}
+	for _, tt := range tests {
+		conn := &fakehttp.ConnAddr{Host: tt.host, Path: tt.path}
+		tp, proxy := pickTarget(conn)
+		if got := tp.addrs(); got != tt.want || proxy != tt.proxy {
+			t.Errorf("%s%s: got %s %d, want %s %d", tt.host, tt.path, got, proxy, tt.want, tt.proxy)
+		}
+	}
+}
+
+func TestMkTLSConfig(t *testing.T) {
+	defer func(min, suites, curves, protos string) {
+		*tlsMin, *tlsSuites, *tlsCurves, *alpn = min, suites, curves, protos
+	}(*tlsMin, *tlsSuites, *tlsCurves, *alpn)
+
+	*tlsMin, *tlsSuites, *tlsCurves, *alpn = "1.3", "ECDHE-CHACHA20,TLS_RSA_WITH_AES_256_GCM_SHA384", "X25519,P256", "http/1.1"
+	cfg, err := mkTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion %x", cfg.MinVersion)
+	}
+	want := append(append([]uint16{}, tlsSuiteGroups["ECDHE-CHACHA20"]...), tls.TLS_RSA_WITH_AES_256_GCM_SHA384)
+	if len(cfg.CipherSuites) != len(want) {
+		t.Fatalf("CipherSuites %v, want %v", cfg.CipherSuites, want)
+	}
+	for i := range want {
+		if cfg.CipherSuites[i] != want[i] {
+			t.Fatalf("CipherSuites %v, want %v", cfg.CipherSuites, want)
+		}
+	}
+	if len(cfg.CurvePreferences) != 2 || cfg.CurvePreferences[0] != tls.X25519 || cfg.CurvePreferences[1] != tls.CurveP256 {
+		t.Errorf("CurvePreferences %v", cfg.CurvePreferences)
+	}
+	if len(cfg.NextProtos) != 1 || cfg.NextProtos[0] != "http/1.1" {
+		t.Errorf("NextProtos %v", cfg.NextProtos)
+	}
+
+	*tlsMin, *tlsSuites, *tlsCurves, *alpn = "1.2", "", "", ""
+	if cfg, err = mkTLSConfig(); err != nil || cfg.MinVersion != tls.VersionTLS12 || cfg.CipherSuites != nil || cfg.NextProtos != nil {
+		t.Fatalf("empty lists: %+v %v", cfg, err)
+	}
+
+	for _, bad := range [][3]string{
+		{"1.1", "", ""},
+		{"1.2", "NO_SUCH_SUITE", ""},
+		{"1.2", "", "P999"},
+	} {
+		*tlsMin, *tlsSuites, *tlsCurves = bad[0], bad[1], bad[2]
+		if _, err := mkTLSConfig(); err == nil {
+			t.Errorf("%v accepted", bad)
+		}
+	}
+}
+
+// self-signed certificate for name, written to crt & key
+func writeTestCert(t *testing.T, crt string, key string, name string) {
+	k, err := genKey("ecdsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := certTemplate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCertKey(crt, key, der, k); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certName(t *testing.T, cr *certReloader) (string) {
+	c, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func waitCertName(t *testing.T, cr *certReloader, name string) {
+	for i := 0; i < 100 && certName(t, cr) != name; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := certName(t, cr); got != name {
+		t.Fatalf("certificate %q, want %q", got, name)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	crt, key := filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key")
+	writeTestCert(t, crt, key, "one")
+
+	cr, err := newCertReloader(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certName(t, cr) != "one" {
+		t.Fatal("first certificate not loaded")
+	}
+
+	sig := make(chan os.Signal, 1)
+	tick := make(chan time.Time, 1)
+	done := make(chan struct{})
+	go func() {
+		cr.loop(sig, tick)
+		close(done)
+	}()
+	defer func() {
+		close(sig)
+		<-done
+	}()
+
+	// SIGHUP reload even if mtime not changed
+	writeTestCert(t, crt, key, "two")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(crt, old, old)
+	os.Chtimes(key, old, old)
+	sig <- syscall.SIGHUP
+	waitCertName(t, cr, "two")
+
+	// tick reload only when file changed
+	writeTestCert(t, crt, key, "three")
+	os.Chtimes(crt, old, old)
+	os.Chtimes(key, old, old)
+	tick <- time.Now()
+	time.Sleep(50 * time.Millisecond)
+	if certName(t, cr) != "two" {
+		t.Fatal("reload without file change")
+	}
+	now := time.Now().Add(time.Minute)
+	os.Chtimes(crt, now, now)
+	tick <- time.Now()
+	waitCertName(t, cr, "three")
+
+	// bad file keep last good one
+	os.WriteFile(crt, []byte("bad"), 0644)
+	sig <- syscall.SIGHUP
+	time.Sleep(50 * time.Millisecond)
+	if certName(t, cr) != "three" {
+		t.Fatal("bad certificate replaced good one")
+	}
+	if _, err := newCertReloader(crt, key); err == nil {
+		t.Fatal("bad certificate loaded")
+	}
+}
+
+func loadTestCert(t *testing.T, fp string) (*x509.Certificate) {
+	pair, err := tls.LoadX509KeyPair(fp, strings.TrimSuffix(fp, ".crt") + ".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestGenCertFiles(t *testing.T) {
+	defer func(crt, key, caCrt, caKey, hosts, alg string, days int) {
+		*crtFile, *keyFile, *genCaCrt, *genCaKey, *genHosts, *genAlg, *genDays = crt, key, caCrt, caKey, hosts, alg, days
+	}(*crtFile, *keyFile, *genCaCrt, *genCaKey, *genHosts, *genAlg, *genDays)
+
+	for _, alg := range []string{"ecdsa", "ed25519"} {
+		dir := t.TempDir()
+		*crtFile, *keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+		*genCaCrt, *genCaKey = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+		*genHosts, *genAlg, *genDays = "a.test,b.test,192.0.2.1", alg, 10
+
+		if err := genCertFiles(); err != nil {
+			t.Fatal(alg, err)
+		}
+		ca := loadTestCert(t, *genCaCrt)
+		leaf := loadTestCert(t, *crtFile)
+		if !ca.IsCA || leaf.IsCA {
+			t.Fatalf("%s: CA %v, leaf %v", alg, ca.IsCA, leaf.IsCA)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		for _, name := range []string{"a.test", "b.test", "192.0.2.1"} {
+			if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+				t.Errorf("%s: verify %s: %v", alg, name, err)
+			}
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "c.test", Roots: roots}); err == nil {
+			t.Errorf("%s: name not in SAN verified", alg)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "a.test"}); err == nil {
+			t.Errorf("%s: verified without CA", alg)
+		}
+
+		if d := time.Until(leaf.NotAfter); d < 9 * 24 * time.Hour || d > 10 * 24 * time.Hour {
+			t.Errorf("%s: NotAfter in %v", alg, d)
+		}
+		if time.Now().Before(leaf.NotBefore) {
+			t.Errorf("%s: not valid now", alg)
+		}
+
+		for fp, mode := range map[string]os.FileMode{*keyFile: 0600, *genCaKey: 0600, *crtFile: 0644} {
+			info, err := os.Stat(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != mode {
+				t.Errorf("%s: %s mode %v, want %v", alg, fp, info.Mode().Perm(), mode)
+			}
+		}
+
+		// exist files kept, exist CA reused
+		if err := genCertFiles(); err != nil {
+			t.Fatal(err)
+		}
+		if !loadTestCert(t, *crtFile).Equal(leaf) {
+			t.Errorf("%s: exist certificate replaced", alg)
+		}
+		os.Remove(*crtFile)
+		os.Remove(*keyFile)
+		if err := genCertFiles(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadTestCert(t, *crtFile).Verify(x509.VerifyOptions{DNSName: "a.test", Roots: roots}); err != nil {
+			t.Errorf("%s: not signed by exist CA: %v", alg, err)
+		}
+	}
+
+	*genAlg = "rsa"
+	os.Remove(*crtFile)
+	if err := genCertFiles(); err == nil {
+		t.Error("unknown key type accepted")
+	}
+}